@@ -0,0 +1,71 @@
+package main
+
+import "sync/atomic"
+
+// 多个连接共享的内存预算，限制所有连接同时缓冲的消息总字节数
+type MemoryBudget struct {
+	limit int64
+	used  int64
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// 返回当前已经占用的字节数
+func (b *MemoryBudget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// 尝试占用 n 个字节的预算，超出预算时不占用并返回 false
+func (b *MemoryBudget) acquire(n int64) bool {
+	for {
+		used := atomic.LoadInt64(&b.used)
+		// 用减法比较，避免对端声明的长度很大时 used+n 溢出成负数
+		if n > b.limit-used {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+// 释放之前占用的 n 个字节
+func (b *MemoryBudget) release(n int64) {
+	atomic.AddInt64(&b.used, -n)
+}
+
+// 多个连接共享的分片消息数限制，限制所有连接同时在拼接中的分片消息总数
+// 防止大量连接各自发送一个分片之后就不再继续，让服务端一直保留这些没有拼接完的消息
+type FragmentBudget struct {
+	limit  int64
+	active int64
+}
+
+func NewFragmentBudget(limit int) *FragmentBudget {
+	return &FragmentBudget{limit: int64(limit)}
+}
+
+// 返回当前正在拼接的分片消息数
+func (b *FragmentBudget) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// 开始拼接一条分片消息，已经达到上限时返回 false
+func (b *FragmentBudget) acquire() bool {
+	for {
+		active := atomic.LoadInt64(&b.active)
+		if active >= b.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.active, active, active+1) {
+			return true
+		}
+	}
+}
+
+// 一条分片消息拼接结束或者被放弃
+func (b *FragmentBudget) release() {
+	atomic.AddInt64(&b.active, -1)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudgetReleasedForDeliveredReply(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	c.budget = NewMemoryBudget(100)
+
+	reply := `{"id":1,"result":"` + strings.Repeat("r", 32) + `"}`
+	next := `{"id":2,"event":"` + strings.Repeat("n", 33) + `"}`
+	go func() {
+		// 等 Request 发出请求之后再发送响应，保证响应到达时请求已经登记
+		if _, err := readTestFrame(peer); err != nil {
+			return
+		}
+		peer.Write(clientFrame(finalBit|TextMessage, []byte(reply)))
+		peer.Write(clientFrame(finalBit|TextMessage, []byte(next)))
+	}()
+
+	replies := make(chan Message, 1)
+	go func() {
+		m, err := c.Request(context.Background(), Message{Type: TextMessage, Data: []byte(`{"id":1}`)})
+		if err != nil {
+			t.Error(err)
+		}
+		replies <- m
+	}()
+
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(data) != next {
+		t.Fatalf("ReadMessage() = %q, want %q", data, next)
+	}
+	if m := <-replies; string(m.Data) != reply {
+		t.Fatalf("Request() = %q, want %q", m.Data, reply)
+	}
+	if used := c.budget.Used(); used != 0 {
+		t.Fatalf("budget used = %d after reading, want 0", used)
+	}
+}
+
+func TestMemoryBudgetExceeded(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	c.budget = NewMemoryBudget(10)
+	finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|BinaryMessage, make([]byte, 11))})
+
+	if _, _, err := c.ReadMessage(); err != ErrMessageTooBig {
+		t.Fatalf("ReadMessage() error = %v, want ErrMessageTooBig", err)
+	}
+	if code := closeCodeOf(finish()); code != CloseMessageTooBig {
+		t.Fatalf("close code = %d, want %d", code, CloseMessageTooBig)
+	}
+	if used := c.budget.Used(); used != 0 {
+		t.Fatalf("budget used = %d, want 0", used)
+	}
+}
+
+func TestMemoryBudgetAcquireOverflow(t *testing.T) {
+	b := NewMemoryBudget(100)
+	if !b.acquire(10) {
+		t.Fatal("acquire(10) = false")
+	}
+	if b.acquire(math.MaxInt64) {
+		t.Fatal("acquire(math.MaxInt64) = true with a 100 byte budget")
+	}
+	if used := b.Used(); used != 10 {
+		t.Fatalf("Used() = %d, want 10", used)
+	}
+}
+
+// 第一个连接的分片消息还没有读完时一直占着预算，第二个连接的消息超出剩下的预算而被拒绝
+func TestMemoryBudgetSharedAcrossConns(t *testing.T) {
+	budget := NewMemoryBudget(100)
+	first, firstPeer := newTestServerConn()
+	defer first.Close()
+	second, secondPeer := newTestServerConn()
+	defer second.Close()
+	first.budget = budget
+	second.budget = budget
+
+	go firstPeer.Write(clientFrame(BinaryMessage, make([]byte, 60)))
+	firstMessage := make(chan error, 1)
+	go func() {
+		_, _, err := first.ReadMessage()
+		firstMessage <- err
+	}()
+	for budget.Used() != 60 {
+		time.Sleep(time.Millisecond)
+	}
+
+	finish := runTestPeer(secondPeer, [][]byte{clientFrame(finalBit|BinaryMessage, make([]byte, 60))})
+	if _, _, err := second.ReadMessage(); err != ErrMessageTooBig {
+		t.Fatalf("second ReadMessage() error = %v, want ErrMessageTooBig", err)
+	}
+	if code := closeCodeOf(finish()); code != CloseMessageTooBig {
+		t.Fatalf("second close code = %d, want %d", code, CloseMessageTooBig)
+	}
+
+	// 第一个连接读完之后释放预算
+	firstPeer.Write(clientFrame(finalBit|ContinuationFrame, make([]byte, 10)))
+	if err := <-firstMessage; err != nil {
+		t.Fatalf("first ReadMessage() error = %v", err)
+	}
+	if used := budget.Used(); used != 0 {
+		t.Fatalf("budget used = %d, want 0", used)
+	}
+	firstPeer.Close()
+}
+
+// 两个连接各自停在分片消息的中间占满全局分片数，第三个连接的分片消息被拒绝，单帧消息不受影响
+func TestFragmentBudgetSaturated(t *testing.T) {
+	budget := NewFragmentBudget(2)
+	var peers []net.Conn
+	var done []chan error
+	for i := 0; i < 2; i++ {
+		c, peer := newTestServerConn()
+		defer c.Close()
+		c.fragmentBudget = budget
+		peers = append(peers, peer)
+		go peer.Write(clientFrame(TextMessage, []byte("part")))
+		errs := make(chan error, 1)
+		go func() {
+			_, _, err := c.ReadMessage()
+			errs <- err
+		}()
+		done = append(done, errs)
+	}
+	for budget.Active() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c, peer := newTestServerConn()
+	defer c.Close()
+	c.fragmentBudget = budget
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|TextMessage, []byte("whole")),
+		clientFrame(TextMessage, []byte("part")),
+	})
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "whole" {
+		t.Fatalf("single frame ReadMessage() = %q, %v", data, err)
+	}
+	if _, _, err := c.ReadMessage(); err != ErrProtocol {
+		t.Fatalf("ReadMessage() error = %v, want ErrProtocol", err)
+	}
+	if code := closeCodeOf(finish()); code != CloseProtocolError {
+		t.Fatalf("close code = %d, want %d", code, CloseProtocolError)
+	}
+
+	// 拼接完成之后释放分片数
+	for i, peer := range peers {
+		peer.Write(clientFrame(finalBit|ContinuationFrame, []byte("end")))
+		if err := <-done[i]; err != nil {
+			t.Fatalf("conn %d ReadMessage() error = %v", i, err)
+		}
+		peer.Close()
+	}
+	if active := budget.Active(); active != 0 {
+		t.Fatalf("Active() = %d, want 0", active)
+	}
+}
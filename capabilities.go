@@ -0,0 +1,56 @@
+package main
+
+import "encoding/json"
+
+// 应用层协商的连接能力
+type Capabilities struct {
+	MaxFrameSize int  `json:"maxFrameSize"` // 单帧 payload 的最大长度，为 0 时不限制
+	Compression  bool `json:"compression"`  // 是否希望压缩
+}
+
+// 在连接建立后用第一组帧和对端协商能力，客户端先发送自己的能力再读取服务端的，服务端先读取再回复，
+// 这样 net.Pipe 这类没有缓冲区的连接上双方也不会同时阻塞在写入上
+// 最大帧长度取双方中较小的一个，只有双方都希望压缩时才启用压缩
+// 协商结果保存在 Conn 上，之后的 SendData 会按照协商出的帧长度分片
+func (c *Conn) NegotiateCapabilities(local Capabilities) (Capabilities, error) {
+	if !c.isServer {
+		if err := c.WriteJSON(local); err != nil {
+			return Capabilities{}, err
+		}
+	}
+
+	data, err := c.ReadData()
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	if c.isServer {
+		if err := c.WriteJSON(local); err != nil {
+			return Capabilities{}, err
+		}
+	}
+
+	var remote Capabilities
+	if err := json.Unmarshal(data, &remote); err != nil {
+		return Capabilities{}, err
+	}
+
+	c.caps = Capabilities{
+		MaxFrameSize: minFrameSize(local.MaxFrameSize, remote.MaxFrameSize),
+		Compression:  local.Compression && remote.Compression,
+	}
+	return c.caps, nil
+}
+
+// 返回协商出的连接能力
+func (c *Conn) Capabilities() Capabilities {
+	return c.caps
+}
+
+// 取两个帧长度中较小的一个，0 表示不限制
+func minFrameSize(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
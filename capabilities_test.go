@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+	// net.Pipe 没有缓冲区，双方同时先写会互相阻塞
+	server, client := newTestConnPair()
+	defer server.Close()
+	defer client.Close()
+
+	type result struct {
+		caps Capabilities
+		err  error
+	}
+	clientResult := make(chan result, 1)
+	go func() {
+		caps, err := client.NegotiateCapabilities(Capabilities{MaxFrameSize: 64, Compression: true})
+		clientResult <- result{caps, err}
+	}()
+	caps, err := server.NegotiateCapabilities(Capabilities{MaxFrameSize: 16})
+	if err != nil {
+		t.Fatalf("server NegotiateCapabilities() error = %v", err)
+	}
+	r := <-clientResult
+	if r.err != nil {
+		t.Fatalf("client NegotiateCapabilities() error = %v", r.err)
+	}
+	want := Capabilities{MaxFrameSize: 16}
+	if caps != want || r.caps != want || server.Capabilities() != want {
+		t.Fatalf("negotiated server %+v, client %+v, want %+v", caps, r.caps, want)
+	}
+
+	// 协商之后发送的消息按照 16 字节的帧长度分片
+	frames := client.DebugFrames()
+	data := bytes.Repeat([]byte("x"), 40)
+	go server.SendData(data)
+	got, err := client.ReadData()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("ReadData() = %q, %v", got, err)
+	}
+	for _, wantLen := range []int64{16, 16, 8} {
+		if f := <-frames; f.Length != wantLen {
+			t.Fatalf("frame length = %d, want %d", f.Length, wantLen)
+		}
+	}
+}
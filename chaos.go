@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// 测试用的故障注入配置，在每次读写底层连接之前先等待 Latency 加上 [0, Jitter) 之间的随机时长，
+// 用来测试客户端在高延迟网络下的表现和超时处理
+// 只有使用 -tags chaos 编译时才会生效，正常编译出来的程序即使设置了也会被忽略，不会误用到线上
+type ChaosConfig struct {
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+// 按照配置包装连接，没有开启 chaos 编译标签或者配置为 nil 时原样返回
+func wrapChaos(conn net.Conn, cfg *ChaosConfig) net.Conn {
+	if !chaosEnabled || cfg == nil {
+		return conn
+	}
+	return &chaosConn{Conn: conn, cfg: *cfg}
+}
+
+type chaosConn struct {
+	net.Conn
+	cfg ChaosConfig
+}
+
+func (cc *chaosConn) delay() {
+	d := cc.cfg.Latency
+	if cc.cfg.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(cc.cfg.Jitter)))
+	}
+	time.Sleep(d)
+}
+
+func (cc *chaosConn) Read(p []byte) (int, error) {
+	cc.delay()
+	return cc.Conn.Read(p)
+}
+
+func (cc *chaosConn) Write(p []byte) (int, error) {
+	cc.delay()
+	return cc.Conn.Write(p)
+}
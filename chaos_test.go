@@ -0,0 +1,27 @@
+//go:build chaos
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChaosLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	addr, conns := newUpgradeTestServer(t, &Upgrader{Chaos: &ChaosConfig{Latency: latency}})
+	_, client, _ := rawHandshake(t, addr, "")
+	c := <-conns
+	defer c.Close()
+
+	start := time.Now()
+	if _, err := client.Write(clientFrame(finalBit|TextMessage, []byte("slow"))); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.ReadData(); err != nil || string(data) != "slow" {
+		t.Fatalf("ReadData() = %q, %v, want %q", data, err, "slow")
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Fatalf("ReadData() took %v, want at least %v", elapsed, latency)
+	}
+}
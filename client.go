@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 客户端读取的 101 响应（状态行加上所有响应头）的最大长度，和 net/http 服务端默认允许的请求头长度相同
+const maxHandshakeResponseSize = http.DefaultMaxHeaderBytes
+
+var errHandshakeResponseTooLarge = errors.New("websocket: handshake response headers too large")
+
+// 服务端返回了 200，或者返回了 101 但是没有 Upgrade、Connection 响应头时 Dial 返回的错误
+// 这通常是中间的透明代理去掉了 Upgrade 请求头，服务端把它当成了普通的 http 请求，可以通过 errors.Is 判断
+var ErrUpgradeIntercepted = errors.New("websocket: handshake response is missing the Upgrade headers, a transparent proxy may have stripped them")
+
+// 客户端连接的配置
+type DialConfig struct {
+	// 连接 wss:// 地址时使用的 TLS 配置，为 nil 时使用默认配置，
+	// 没有设置 ServerName 时使用地址中的主机名校验服务端证书
+	TLSClientConfig *tls.Config
+
+	// 开启后在握手请求中提供 permessage-deflate（双方都不保留上下文），服务端接受时启用压缩，
+	// 服务端选择的扩展和参数可以通过 Conn.NegotiatedExtensions 查看
+	EnableCompression bool
+
+	// 设置后在握手请求中提供使用这个字典的 x-deflate-dictionary，服务端配置了内容相同的字典时以它压缩和解压消息，
+	// 同时开启了 EnableCompression 时优先使用字典，服务端不支持时再使用 permessage-deflate
+	CompressionDictionary *CompressionDictionary
+
+	// 开启后在握手请求中提供 x-no-mask，服务端接受时发送的帧不再带掩码，省掉给每个字节做异或的开销
+	// 注意这不符合 RFC 6455，默认关闭，只能用于两端都由自己控制、中间没有代理的可信内网，服务端需要开启 Upgrader.AllowNoMask
+	NoMask bool
+}
+
+// 使用默认配置连接 websocket 服务端，见 DialConfig.Dial
+func Dial(urlStr string, header http.Header) (*Conn, error) {
+	return (&DialConfig{}).Dial(urlStr, header)
+}
+
+// 作为客户端连接 websocket 服务端，支持 ws:// 和 wss:// 两种地址，
+// 地址中没有端口时分别使用 80 和 443，header 中的请求头会随握手请求一起发送，比如 Authorization、Cookie，
+// Upgrade、Connection 和 Sec-WebSocket-Key 等握手使用的请求头由 Dial 设置，header 中包含它们时返回错误，
+// 子协议可以通过 Sec-WebSocket-Protocol 提供
+// wss:// 地址会在建立 TCP 连接之后先完成 TLS 握手，之后的帧都经过 tls.Conn 读写
+func (d *DialConfig) Dial(urlStr string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var useTLS bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		useTLS = true
+	default:
+		return nil, errors.New("websocket: bad scheme " + u.Scheme)
+	}
+
+	hostPort := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if useTLS {
+			port = "443"
+		}
+		hostPort = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := net.Dial("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if useTLS {
+		var cfg *tls.Config
+		if d.TLSClientConfig != nil {
+			cfg = d.TLSClientConfig.Clone()
+		} else {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c, err := d.clientHandshake(conn, u, header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// 在已经建立好的连接上完成客户端握手
+func (d *DialConfig) clientHandshake(conn net.Conn, u *url.URL, header http.Header) (*Conn, error) {
+	challengeKey, err := generateChallengeKey()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		k = http.CanonicalHeaderKey(k)
+		switch k {
+		case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions":
+			// 这些请求头由握手过程设置，扩展通过 DialConfig 开启，调用方设置了反而会让握手或者之后的读取失败
+			return nil, errors.New("websocket: handshake header not allowed: " + k)
+		case "Sec-Websocket-Protocol":
+			// 多个子协议合并成一个请求头，服务端只会读取第一个 Sec-WebSocket-Protocol
+			req.Header.Set(k, strings.Join(append(req.Header.Values(k), v...), ", "))
+		default:
+			req.Header[k] = append(req.Header[k], v...)
+		}
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", challengeKey)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	// 按照偏好的顺序提供扩展
+	var offers []string
+	if d.CompressionDictionary != nil {
+		offers = append(offers, d.CompressionDictionary.extension())
+	}
+	if d.EnableCompression {
+		offers = append(offers, compressionOffer)
+	}
+	if d.NoMask {
+		offers = append(offers, noMaskExtension)
+	}
+	if len(offers) > 0 {
+		req.Header.Set("Sec-WebSocket-Extensions", strings.Join(offers, ", "))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	// 握手响应之后紧跟着的帧可能已经被读进缓冲区，所以连接之后也要继续使用这个缓冲读取器
+	// 读取响应头时限制长度，避免服务端发送没有尽头的响应头，读完之后再取消限制
+	lr := &io.LimitedReader{R: conn, N: maxHandshakeResponseSize}
+	br := bufio.NewReader(lr)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		if lr.N <= 0 {
+			return nil, errHandshakeResponseTooLarge
+		}
+		return nil, err
+	}
+	lr.N = math.MaxInt64
+
+	upgraded := tokenListContainsValue(resp.Header, "Upgrade", "websocket") &&
+		tokenListContainsValue(resp.Header, "Connection", "upgrade")
+	if resp.StatusCode == http.StatusOK || (resp.StatusCode == http.StatusSwitchingProtocols && !upgraded) {
+		return nil, fmt.Errorf("%w (server responded %s %s)", ErrUpgradeIntercepted, resp.Proto, resp.Status)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !upgraded ||
+		resp.Header.Get("Sec-Websocket-Accept") != computeAcceptKey(challengeKey) {
+		return nil, fmt.Errorf("websocket: bad handshake, server responded %s %s", resp.Proto, resp.Status)
+	}
+	// 服务端只能从客户端提供的扩展中选择，选择了其他扩展时之后的帧都无法正确解析
+	exts := parseExtensions(resp.Header)
+	// 两个压缩扩展都使用 RSV1 位，服务端最多只能选择其中一个
+	var compression, noMask bool
+	var compressionParams map[string]string
+	var dict *CompressionDictionary
+	for _, ext := range exts {
+		switch {
+		case ext.Name == noMaskExtension:
+			if d.NoMask && !noMask && len(ext.Params) == 0 {
+				noMask = true
+				continue
+			}
+		case compression:
+		case ext.Name == compressionExtension && d.EnableCompression && acceptsCompressionResponse(ext.Params):
+			compression = true
+			compressionParams = ext.Params
+			continue
+		case d.CompressionDictionary.matches(ext):
+			compression = true
+			dict = d.CompressionDictionary
+			continue
+		}
+		return nil, errors.New("websocket: server selected unsupported extension " + resp.Header.Get("Sec-Websocket-Extensions"))
+	}
+
+	c := newConn(conn, br, false)
+	c.extensions = exts
+	c.noMask = noMask
+	if compression {
+		c.compression = true
+		c.compressionInfo = clientCompressionInfo(compressionParams)
+	}
+	if dict != nil {
+		c.dictionary = dict
+		c.compressionInfo.Dictionary = dict.id
+		c.compressionInfo.Level = dictionaryCompressionLevel
+	}
+	// 服务端从客户端在请求头中提供的子协议里选出的那个
+	c.subprotocol = resp.Header.Get("Sec-Websocket-Protocol")
+	return c, nil
+}
+
+// 随机生成 16 字节并进行 base64 编码，作为 Sec-WebSocket-Key
+func generateChallengeKey() (string, error) {
+	p := make([]byte, 16)
+	if _, err := rand.Read(p); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(p), nil
+}
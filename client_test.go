@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 在 net.Pipe 的另一端模拟服务端：读取握手请求，然后调用 respond 写回响应，respond 返回之后关闭连接
+func dialTestServer(t *testing.T, respond func(conn net.Conn, r *http.Request)) (*Conn, error) {
+	t.Helper()
+	a, b := net.Pipe()
+	go func() {
+		defer b.Close()
+		r, err := http.ReadRequest(bufio.NewReader(b))
+		if err != nil {
+			return
+		}
+		respond(b, r)
+	}()
+
+	u, _ := url.Parse("ws://example.com/chat")
+	c, err := (&DialConfig{}).clientHandshake(a, u, nil)
+	if err != nil {
+		a.Close()
+	}
+	return c, err
+}
+
+// 返回一个合法的 101 响应的状态行和响应头，不包括结尾的空行
+func switchingProtocolsHead(r *http.Request) string {
+	return "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAcceptKey(r.Header.Get("Sec-Websocket-Key")) + "\r\n"
+}
+
+func TestDialRejectsOversizedResponseHeaders(t *testing.T) {
+	_, err := dialTestServer(t, func(conn net.Conn, r *http.Request) {
+		fmt.Fprint(conn, switchingProtocolsHead(r))
+		line := "X-Filler: " + strings.Repeat("a", 1000) + "\r\n"
+		for i := 0; i < maxHandshakeResponseSize/len(line)+2; i++ {
+			if _, err := fmt.Fprint(conn, line); err != nil {
+				return
+			}
+		}
+		fmt.Fprint(conn, "\r\n")
+	})
+	if err != errHandshakeResponseTooLarge {
+		t.Fatalf("clientHandshake() error = %v, want %v", err, errHandshakeResponseTooLarge)
+	}
+}
+
+func TestDialAcceptsLargeResponseWithinLimit(t *testing.T) {
+	c, err := dialTestServer(t, func(conn net.Conn, r *http.Request) {
+		fmt.Fprint(conn, switchingProtocolsHead(r)+"X-Filler: "+strings.Repeat("a", 4096)+"\r\n\r\n")
+		// 响应之后的帧不受响应头长度限制
+		conn.Write(buildTestFrame(finalBit|BinaryMessage, false, make([]byte, maxHandshakeResponseSize)))
+	})
+	if err != nil {
+		t.Fatalf("clientHandshake() error = %v", err)
+	}
+	defer c.Close()
+	_, data, err := c.ReadMessage()
+	if err != nil || len(data) != maxHandshakeResponseSize {
+		t.Fatalf("ReadMessage() = %d bytes, %v", len(data), err)
+	}
+}
+
+func TestDialDetectsInterceptedUpgrade(t *testing.T) {
+	responses := map[string]func(r *http.Request) string{
+		"200": func(r *http.Request) string {
+			return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+		},
+		"101 without Upgrade": func(r *http.Request) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Accept: " + computeAcceptKey(r.Header.Get("Sec-Websocket-Key")) + "\r\n\r\n"
+		},
+		"101 without Connection": func(r *http.Request) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n" +
+				"Sec-WebSocket-Accept: " + computeAcceptKey(r.Header.Get("Sec-Websocket-Key")) + "\r\n\r\n"
+		},
+	}
+	for name, response := range responses {
+		_, err := dialTestServer(t, func(conn net.Conn, r *http.Request) {
+			fmt.Fprint(conn, response(r))
+		})
+		if !errors.Is(err, ErrUpgradeIntercepted) {
+			t.Errorf("%s: clientHandshake() error = %v, want ErrUpgradeIntercepted", name, err)
+		}
+	}
+
+	// 其他失败仍然返回普通的握手错误
+	_, err := dialTestServer(t, func(conn net.Conn, r *http.Request) {
+		fmt.Fprint(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+	})
+	if err == nil || errors.Is(err, ErrUpgradeIntercepted) || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Errorf("403: clientHandshake() error = %v", err)
+	}
+}
+
+func TestDialNegotiatedExtensions(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{EnableCompression: true})
+	c, err := (&DialConfig{EnableCompression: true}).Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	server := <-conns
+	defer server.Close()
+
+	want := []Extension{{
+		Name:   "permessage-deflate",
+		Params: map[string]string{"server_no_context_takeover": "", "client_no_context_takeover": ""},
+	}}
+	if got := c.NegotiatedExtensions(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("NegotiatedExtensions() = %+v, want %+v", got, want)
+	}
+	if !c.CompressionInfo().Enabled {
+		t.Fatal("CompressionInfo().Enabled = false on the client")
+	}
+
+	// 两个方向的消息都经过压缩，并且都能正确解压
+	msg := strings.Repeat("compress me ", 100)
+	frames := server.DebugFrames()
+	go c.SendData([]byte(msg))
+	if _, data, err := server.ReadMessage(); err != nil || string(data) != msg {
+		t.Fatalf("server ReadMessage() = %d bytes, %v", len(data), err)
+	}
+	if f := <-frames; !f.Compressed || f.Length >= int64(len(msg)) {
+		t.Fatalf("client frame = %+v, want a compressed frame shorter than %d", f, len(msg))
+	}
+	go server.SendData([]byte(msg))
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != msg {
+		t.Fatalf("client ReadMessage() = %d bytes, %v", len(data), err)
+	}
+}
+
+func TestDialWithoutCompression(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{EnableCompression: true})
+	c, err := Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	(<-conns).Close()
+	if exts := c.NegotiatedExtensions(); exts != nil {
+		t.Fatalf("NegotiatedExtensions() = %+v, want none", exts)
+	}
+}
+
+func TestDialRejectsUnofferedExtension(t *testing.T) {
+	_, err := dialTestServer(t, func(conn net.Conn, r *http.Request) {
+		fmt.Fprint(conn, switchingProtocolsHead(r)+"Sec-WebSocket-Extensions: "+compressionResponse+"\r\n\r\n")
+	})
+	if err == nil || !strings.Contains(err.Error(), "unsupported extension") {
+		t.Fatalf("clientHandshake() error = %v, want unsupported extension", err)
+	}
+}
+
+func TestDialSendsClientHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	u := &Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		if c, err := u.Upgrade(w, r); err == nil {
+			c.Close()
+		}
+	}))
+	defer srv.Close()
+
+	header := http.Header{
+		"Authorization":          {"Bearer secret-token"},
+		"Cookie":                 {"session=abc"},
+		"X-Request-Id":           {"42"},
+		"Sec-Websocket-Protocol": {"chat", "superchat"},
+	}
+	c, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/", header)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	c.Close()
+
+	got := <-headers
+	for k, v := range map[string]string{
+		"Authorization":          "Bearer secret-token",
+		"Cookie":                 "session=abc",
+		"X-Request-Id":           "42",
+		"Sec-Websocket-Protocol": "chat, superchat",
+		"Upgrade":                "websocket",
+	} {
+		if got.Get(k) != v {
+			t.Errorf("handshake request %s = %q, want %q", k, got.Get(k), v)
+		}
+	}
+}
+
+func TestDialRejectsReservedHeaders(t *testing.T) {
+	for _, k := range []string{"Upgrade", "Connection", "Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Extensions"} {
+		a, b := net.Pipe()
+		u, _ := url.Parse("ws://example.com/chat")
+		// 请求头在写出握手请求之前检查，另一端不需要读取
+		_, err := (&DialConfig{}).clientHandshake(a, u, http.Header{k: {"x"}})
+		a.Close()
+		b.Close()
+		if err == nil || !strings.Contains(err.Error(), "header not allowed") {
+			t.Errorf("Dial() with %s error = %v, want header not allowed", k, err)
+		}
+	}
+}
+
+// 把 httptest 服务器的 http(s):// 地址换成 ws(s):// 地址
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestDialEcho(t *testing.T) {
+	srv := httptest.NewServer(Handler(echo))
+	defer srv.Close()
+
+	c, err := Dial(wsURL(srv)+"/echo", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	for _, msg := range []string{"hello", strings.Repeat("x", 300)} {
+		if err := c.SendData([]byte(msg)); err != nil {
+			t.Fatalf("SendData() error = %v", err)
+		}
+		if typ, data, err := c.ReadMessage(); err != nil || typ != TextMessage || string(data) != msg {
+			t.Fatalf("ReadMessage() = %d, %d bytes, %v, want the echo of %d bytes", typ, len(data), err, len(msg))
+		}
+	}
+}
+
+func TestIsServer(t *testing.T) {
+	server := make(chan *Conn, 1)
+	srv := httptest.NewServer(Handler(func(c *Conn) {
+		server <- c
+		c.ReadData()
+	}))
+	defer srv.Close()
+
+	c, err := Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	if c.IsServer() {
+		t.Error("dialed conn IsServer() = true, want false")
+	}
+	if !(<-server).IsServer() {
+		t.Error("upgraded conn IsServer() = false, want true")
+	}
+}
+
+func TestDialTLSEcho(t *testing.T) {
+	srv := httptest.NewTLSServer(Handler(echo))
+	defer srv.Close()
+
+	// 使用信任测试证书的 TLS 配置，默认配置会因为证书不受信任而握手失败
+	if _, err := Dial(wsURL(srv)+"/echo", nil); err == nil {
+		t.Fatal("Dial() with an untrusted certificate succeeded")
+	}
+	d := &DialConfig{TLSClientConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+	c, err := d.Dial(wsURL(srv)+"/echo", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.SendBinary([]byte{0, 1, 2}); err != nil {
+		t.Fatalf("SendBinary() error = %v", err)
+	}
+	if typ, data, err := c.ReadMessage(); err != nil || typ != BinaryMessage || string(data) != "\x00\x01\x02" {
+		t.Fatalf("ReadMessage() = %d, %q, %v", typ, data, err)
+	}
+}
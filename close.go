@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// 关闭连接的状态码，参见 RFC 6455 7.4.1
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+	CloseBadGateway              = 1014
+	CloseTLSHandshake            = 1015
+)
+
+// 控制帧 payload 的最大长度
+const maxControlFramePayload = 125
+
+// 发送 close 帧的超时时间，避免对端不读取数据时关闭流程一直阻塞
+const closeWriteTimeout = 5 * time.Second
+
+var (
+	ErrInvalidUTF8   = errors.New("websocket: invalid utf8 in text message")
+	ErrMessageTooBig = errors.New("websocket: message too big")
+	ErrCloseSent     = errors.New("websocket: close sent")
+	ErrProtocol      = errors.New("websocket: protocol error")
+
+	ErrCloseReasonTooLong = errors.New("websocket: close reason too long")
+)
+
+// 收到对端的 close 帧时读取返回的错误，可以通过 errors.As 取出状态码和原因
+type CloseError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// 设置接受的控制帧 payload 的最大长度，收到更大的控制帧时以 1002 关闭连接
+// 规范规定控制帧最长 125 字节，所以 n 小于 0 或超过 125 时都按 125 处理，默认也是 125
+func (c *Conn) SetMaxControlFramePayload(n int) {
+	if n < 0 || n > maxControlFramePayload {
+		n = maxControlFramePayload
+	}
+	c.maxControlPayload = int64(n)
+}
+
+// 根据错误推断 close 状态码：
+// nil 对应 1000，ErrProtocol 对应 1002，ErrInvalidUTF8 对应 1007，ErrMessageTooBig 对应 1009，
+// 其他错误都对应 1011
+func closeCodeForError(err error) uint16 {
+	switch {
+	case err == nil:
+		return CloseNormalClosure
+	case errors.Is(err, ErrProtocol):
+		return CloseProtocolError
+	case errors.Is(err, ErrInvalidUTF8):
+		return CloseInvalidFramePayloadData
+	case errors.Is(err, ErrMessageTooBig):
+		return CloseMessageTooBig
+	default:
+		return CloseInternalServerErr
+	}
+}
+
+// 根据错误发送对应状态码的 close 帧并关闭连接
+// close 原因取自错误信息，超出控制帧长度的部分会被截断
+func (c *Conn) CloseWithError(err error) error {
+	reason := ""
+	if err != nil {
+		reason = truncateReason(err.Error(), maxControlFramePayload-2)
+	}
+	return c.SendClose(closeCodeForError(err), reason)
+}
+
+// 发送带状态码和原因的 close 帧，然后关闭连接
+// 控制帧的 payload 不能超过 125 字节，去掉 2 字节的状态码之后原因最长只能有 123 字节
+// 对端一直不读取数据时，最多等待 5 秒就放弃发送 close 帧直接关闭连接
+func (c *Conn) SendClose(code uint16, reason string) error {
+	if 2+len(reason) > maxControlFramePayload {
+		return ErrCloseReasonTooLong
+	}
+
+	err := c.WriteControl(CloseMessage, closePayload(code, reason), time.Now().Add(closeWriteTimeout))
+	c.Close()
+	return err
+}
+
+// 组装 close 帧的 payload：大端序的 2 字节状态码加上 UTF-8 编码的原因
+func closePayload(code uint16, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	return append(payload, reason...)
+}
+
+// 判断收到的 close 状态码是否合法：标准中定义的状态码以及 3000-4999 的注册和私有状态码是合法的，
+// 1004 是保留的，1005、1006、1015 只能在本地使用，不能出现在 close 帧中
+func isValidReceivedCloseCode(code int) bool {
+	switch code {
+	case CloseNormalClosure, CloseGoingAway, CloseProtocolError, CloseUnsupportedData,
+		CloseInvalidFramePayloadData, ClosePolicyViolation, CloseMessageTooBig,
+		CloseMandatoryExtension, CloseInternalServerErr, CloseServiceRestart, CloseTryAgainLater, CloseBadGateway:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// 把原因截断到不超过 n 个字节，并且不会把一个 UTF-8 字符截成两半
+func truncateReason(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// 半关闭连接：发送状态码为 1000 的 close 帧，之后不能再写入，但仍然可以继续读取对端发来的消息，
+// 直到收到对端回应的 close 帧时才真正关闭底层连接
+func (c *Conn) CloseWrite() error {
+	return c.WriteControl(CloseMessage, closePayload(CloseNormalClosure, ""), time.Now().Add(closeWriteTimeout))
+}
+
+// close 状态码的简短名字和建议的日志级别，日志级别为 "info"、"warn" 或 "error"
+type CloseInfo struct {
+	Name     string
+	Severity string
+}
+
+var closeInfos = map[int]CloseInfo{
+	CloseNormalClosure:           {"normal", "info"},
+	CloseGoingAway:               {"going_away", "info"},
+	CloseProtocolError:           {"protocol", "warn"},
+	CloseUnsupportedData:         {"unsupported_data", "warn"},
+	CloseNoStatusReceived:        {"no_status", "info"},
+	CloseAbnormalClosure:         {"abnormal", "error"},
+	CloseInvalidFramePayloadData: {"invalid_payload", "warn"},
+	ClosePolicyViolation:         {"policy", "warn"},
+	CloseMessageTooBig:           {"too_big", "warn"},
+	CloseMandatoryExtension:      {"mandatory_extension", "warn"},
+	CloseInternalServerErr:       {"internal", "error"},
+	CloseServiceRestart:          {"service_restart", "info"},
+	CloseTryAgainLater:           {"try_again_later", "warn"},
+	CloseBadGateway:              {"bad_gateway", "error"},
+	CloseTLSHandshake:            {"tls_handshake", "error"},
+}
+
+// 返回 close 状态码对应的名字和日志级别，便于把状态码转换成日志或者 HTTP 语义
+// 3000-3999 是注册给库和框架使用的状态码，4000-4999 是应用私有的状态码，其他未知的状态码都返回 unknown
+func CloseCodeInfo(code int) CloseInfo {
+	if info, ok := closeInfos[code]; ok {
+		return info
+	}
+	switch {
+	case code >= 3000 && code <= 3999:
+		return CloseInfo{"registered", "info"}
+	case code >= 4000 && code <= 4999:
+		return CloseInfo{"private", "info"}
+	default:
+		return CloseInfo{"unknown", "warn"}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIsValidReceivedCloseCode(t *testing.T) {
+	cases := map[int]bool{
+		999:  false,
+		1000: true,
+		1003: true,
+		1004: false,
+		1005: false,
+		1006: false,
+		1011: true,
+		1014: true,
+		1015: false,
+		1016: false,
+		2999: false,
+		3000: true,
+		4000: true,
+		4999: true,
+		5000: false,
+	}
+	for code, want := range cases {
+		if got := isValidReceivedCloseCode(code); got != want {
+			t.Errorf("isValidReceivedCloseCode(%d) = %v, want %v", code, got, want)
+		}
+	}
+}
+
+func TestStrictCloseCodes(t *testing.T) {
+	cases := []struct {
+		code   uint16
+		strict bool
+		want   int // 服务端回应的状态码
+	}{
+		{4000, false, 4000},
+		{4000, true, 4000},
+		{CloseBadGateway, true, CloseBadGateway},
+		{1004, false, CloseNormalClosure},
+		{1004, true, CloseProtocolError},
+	}
+	for _, tc := range cases {
+		c, peer := newTestServerConn()
+		c.strictCloseCodes = tc.strict
+		finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|CloseMessage, closePayload(tc.code, ""))})
+
+		_, _, err := c.ReadMessage()
+		var ce *CloseError
+		if tc.want == CloseProtocolError {
+			if err != ErrProtocol {
+				t.Errorf("code %d strict=%v: ReadMessage() error = %v, want ErrProtocol", tc.code, tc.strict, err)
+			}
+		} else if !errors.As(err, &ce) || ce.Code != tc.code {
+			t.Errorf("code %d strict=%v: ReadMessage() error = %v, want CloseError", tc.code, tc.strict, err)
+		}
+		if got := closeCodeOf(finish()); got != tc.want {
+			t.Errorf("code %d strict=%v: replied %d, want %d", tc.code, tc.strict, got, tc.want)
+		}
+		c.Close()
+	}
+}
+
+func TestCloseReplyCode(t *testing.T) {
+	cases := []struct {
+		payload []byte
+		want    int // 服务端回应的状态码，CloseNoStatusReceived 表示回应的 close 帧没有 payload
+	}{
+		{nil, CloseNoStatusReceived},
+		{closePayload(CloseNormalClosure, "bye"), CloseNormalClosure},
+		{closePayload(CloseGoingAway, ""), CloseGoingAway},
+		{closePayload(4321, ""), 4321},
+		{closePayload(CloseNoStatusReceived, ""), CloseNormalClosure},
+		{closePayload(CloseAbnormalClosure, ""), CloseNormalClosure},
+		{closePayload(CloseTLSHandshake, ""), CloseNormalClosure},
+	}
+	for _, tc := range cases {
+		c, peer := newTestServerConn()
+		finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|CloseMessage, tc.payload)})
+
+		if _, _, err := c.ReadMessage(); err == nil {
+			t.Errorf("payload %v: ReadMessage() succeeded", tc.payload)
+		}
+		frames := finish()
+		if got := closeCodeOf(frames); got != tc.want {
+			t.Errorf("payload %v: replied %d, want %d", tc.payload, got, tc.want)
+		}
+		// 回应的 close 帧只带状态码，不带原因
+		for _, f := range frames {
+			if f.opcode() == CloseMessage && len(f.payload) > 2 {
+				t.Errorf("payload %v: reply payload = %q", tc.payload, f.payload)
+			}
+		}
+		c.Close()
+	}
+}
+
+// 一端调用 CloseWrite 之后仍然可以读到对端在 close 之前发送的最后一条消息，
+// 对端回应 close 之后，发起方随后的读取返回 CloseError 而不是 EOF
+func TestCloseWriteHandshake(t *testing.T) {
+	server, client := newTCPConnPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	clientErr := make(chan error, 1)
+	go func() {
+		if err := client.SendData([]byte("last")); err != nil {
+			clientErr <- err
+			return
+		}
+		_, _, err := client.ReadMessage()
+		clientErr <- err
+	}()
+
+	if err := server.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if typ, data, err := server.ReadMessage(); err != nil || typ != TextMessage || string(data) != "last" {
+		t.Fatalf("server ReadMessage() = %d, %q, %v, want the last message", typ, data, err)
+	}
+	_, _, err := server.ReadMessage()
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != CloseNormalClosure {
+		t.Fatalf("server ReadMessage() error = %v, want close 1000", err)
+	}
+	if err := <-clientErr; !errors.As(err, &ce) || ce.Code != CloseNormalClosure {
+		t.Fatalf("client ReadMessage() error = %v, want close 1000", err)
+	}
+}
+
+func TestReadMaskedClosePayload(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|CloseMessage, closePayload(CloseNormalClosure, "done"))})
+	defer finish()
+
+	_, _, err := c.ReadMessage()
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("ReadMessage() error = %v, want *CloseError", err)
+	}
+	if ce.Code != CloseNormalClosure || ce.Reason != "done" {
+		t.Fatalf("close = %d %q, want %d %q", ce.Code, ce.Reason, CloseNormalClosure, "done")
+	}
+}
+
+func TestSendCloseFrameBytes(t *testing.T) {
+	c, rc := newRecordConn(true)
+	if err := c.SendClose(CloseNormalClosure, "bye"); err != nil {
+		t.Fatalf("SendClose() error = %v", err)
+	}
+	// FIN + opcode 8，payload 长度 5，状态码 1000 = 0x03e8，然后是原因 "bye"
+	want := []byte{0x88, 0x05, 0x03, 0xe8, 'b', 'y', 'e'}
+	if got := rc.buf.Bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("close frame = % x, want % x", got, want)
+	}
+	if c.Context().Err() == nil {
+		t.Fatal("connection not closed after SendClose")
+	}
+
+	// 原因太长时不发送任何数据
+	c, rc = newRecordConn(true)
+	if err := c.SendClose(CloseNormalClosure, strings.Repeat("x", 124)); err != ErrCloseReasonTooLong {
+		t.Fatalf("SendClose() with a 124-byte reason error = %v, want ErrCloseReasonTooLong", err)
+	}
+	if rc.buf.Len() != 0 {
+		t.Fatalf("wrote % x for a rejected close", rc.buf.Bytes())
+	}
+}
+
+// 开启 DiscardDataAfterClose 时，发送 close 帧之后收到的数据被丢弃，ping 仍然会回复 pong
+func TestDiscardDataAfterClose(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	c.discardAfterClose = true
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|TextMessage, []byte("late")),
+		clientFrame(finalBit|PingMessage, []byte("p")),
+		clientFrame(finalBit|CloseMessage, closePayload(CloseNormalClosure, "")),
+	})
+
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := c.ReadMessage()
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != CloseNormalClosure {
+		t.Fatalf("ReadMessage() = %q, %v, want close 1000", data, err)
+	}
+
+	frames := finish()
+	if len(frames) != 2 || frames[0].opcode() != CloseMessage ||
+		frames[1].opcode() != PongMessage || string(frames[1].payload) != "p" {
+		t.Fatalf("peer received %+v, want close then pong", frames)
+	}
+}
+
+func TestCloseCodeInfo(t *testing.T) {
+	cases := []struct {
+		code int
+		want CloseInfo
+	}{
+		{CloseNormalClosure, CloseInfo{"normal", "info"}},
+		{CloseGoingAway, CloseInfo{"going_away", "info"}},
+		{CloseProtocolError, CloseInfo{"protocol", "warn"}},
+		{CloseUnsupportedData, CloseInfo{"unsupported_data", "warn"}},
+		{CloseNoStatusReceived, CloseInfo{"no_status", "info"}},
+		{CloseAbnormalClosure, CloseInfo{"abnormal", "error"}},
+		{CloseInvalidFramePayloadData, CloseInfo{"invalid_payload", "warn"}},
+		{ClosePolicyViolation, CloseInfo{"policy", "warn"}},
+		{CloseMessageTooBig, CloseInfo{"too_big", "warn"}},
+		{CloseMandatoryExtension, CloseInfo{"mandatory_extension", "warn"}},
+		{CloseInternalServerErr, CloseInfo{"internal", "error"}},
+		{CloseServiceRestart, CloseInfo{"service_restart", "info"}},
+		{CloseTryAgainLater, CloseInfo{"try_again_later", "warn"}},
+		{CloseBadGateway, CloseInfo{"bad_gateway", "error"}},
+		{CloseTLSHandshake, CloseInfo{"tls_handshake", "error"}},
+		{1004, CloseInfo{"unknown", "warn"}},
+		{3000, CloseInfo{"registered", "info"}},
+		{4999, CloseInfo{"private", "info"}},
+		{5000, CloseInfo{"unknown", "warn"}},
+	}
+	for _, tc := range cases {
+		if got := CloseCodeInfo(tc.code); got != tc.want {
+			t.Errorf("CloseCodeInfo(%d) = %+v, want %+v", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{nil, CloseNormalClosure},
+		{ErrInvalidUTF8, CloseInvalidFramePayloadData},
+		{ErrMessageTooBig, CloseMessageTooBig},
+		{fmt.Errorf("read json: %w", ErrMessageTooBig), CloseMessageTooBig},
+		{errors.New("database unavailable"), CloseInternalServerErr},
+	}
+	for _, tc := range cases {
+		c, peer := newTestServerConn()
+		finish := runTestPeer(peer, nil)
+		c.CloseWithError(tc.err)
+
+		frames := finish()
+		if got := closeCodeOf(frames); got != tc.code {
+			t.Errorf("CloseWithError(%v): close code = %d, want %d", tc.err, got, tc.code)
+			continue
+		}
+		want := ""
+		if tc.err != nil {
+			want = tc.err.Error()
+		}
+		if _, reason := parseClosePayload(frames[0].payload); reason != want {
+			t.Errorf("CloseWithError(%v): reason = %q, want %q", tc.err, reason, want)
+		}
+	}
+}
+
+func TestSetMaxControlFramePayload(t *testing.T) {
+	tests := []struct {
+		limit  int
+		ping   int
+		reject bool
+	}{
+		{10, 10, false},
+		{10, 11, true},
+		// 超过 125 时按 125 处理
+		{200, 125, false},
+		{200, 126, true},
+		{-1, 126, true},
+	}
+	for _, tt := range tests {
+		c, peer := newTestServerConn()
+		c.SetMaxControlFramePayload(tt.limit)
+		finish := runTestPeer(peer, [][]byte{
+			clientFrame(finalBit|PingMessage, bytes.Repeat([]byte("p"), tt.ping)),
+			clientFrame(finalBit|TextMessage, []byte("after")),
+		})
+
+		data, err := c.ReadData()
+		frames := finish()
+		if tt.reject {
+			if err != ErrProtocol || closeCodeOf(frames) != CloseProtocolError {
+				t.Errorf("limit %d, ping %d bytes: ReadData() error = %v, close code %d, want ErrProtocol and 1002",
+					tt.limit, tt.ping, err, closeCodeOf(frames))
+			}
+		} else if err != nil || string(data) != "after" || len(frames) != 1 || frames[0].opcode() != PongMessage {
+			t.Errorf("limit %d, ping %d bytes: ReadData() = %q, %v, peer received %d frames, want the pong and the message",
+				tt.limit, tt.ping, data, err, len(frames))
+		}
+		c.Close()
+	}
+}
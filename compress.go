@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// permessage-deflate 扩展，参见 RFC 7692
+// 只支持 no context takeover，双方的压缩器和解压器都不会在消息之间保留滑动窗口，每条消息都可以单独解压
+const compressionExtension = "permessage-deflate"
+
+// 服务端接受 permessage-deflate 时返回的扩展参数
+const compressionResponse = compressionExtension + "; server_no_context_takeover; client_no_context_takeover"
+
+// 客户端提供的 permessage-deflate，要求双方都不保留上下文
+const compressionOffer = compressionResponse
+
+// 每条压缩消息都以同步刷新产生的 0x00 0x00 0xff 0xff 结尾，发送时要去掉这 4 个字节
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// 解压时把去掉的 4 个字节补回来，再加上一个空的最后一块，这样解压器读到末尾时会正常返回 io.EOF
+var inflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// 握手时协商出的 permessage-deflate 参数，用于日志和排查互通问题，见 Conn.CompressionInfo
+type CompressionInfo struct {
+	Enabled                 bool // 是否启用了压缩，没有启用时其他字段都是零值
+	ServerNoContextTakeover bool // 服务端是否在每条消息之后重置压缩器
+	ClientNoContextTakeover bool // 客户端是否在每条消息之后重置压缩器
+	ServerMaxWindowBits     int  // 服务端压缩使用的滑动窗口大小，compress/flate 固定使用 15
+	ClientMaxWindowBits     int  // 客户端压缩可以使用的滑动窗口大小，响应中没有限制它，所以为 15
+	Level                   int  // 本端压缩使用的级别
+
+	Dictionary string // 协商出的共享压缩字典的 id，没有使用字典时为空，见 CompressionDictionary
+}
+
+// 服务端接受 permessage-deflate 时协商出的参数，和 compressionResponse 一致
+var negotiatedCompression = CompressionInfo{
+	Enabled:                 true,
+	ServerNoContextTakeover: true,
+	ClientNoContextTakeover: true,
+	ServerMaxWindowBits:     15,
+	ClientMaxWindowBits:     15,
+	Level:                   flate.BestSpeed,
+}
+
+// 返回握手时协商出的压缩参数，没有协商 permessage-deflate 或 x-deflate-dictionary 时 Enabled 为 false
+func (c *Conn) CompressionInfo() CompressionInfo {
+	return c.compressionInfo
+}
+
+// 压缩后的长度达到压缩前的这个比例时认为压缩效果很差，见 SetPoorCompressionHandler
+const poorCompressionRatio = 0.9
+
+// 设置压缩效果很差时调用的回调，用于观察压缩是否适合当前的消息，比如已经压缩过的图片或者随机数据
+// 启用了 permessage-deflate 时，一条消息压缩后的长度 out 达到压缩前的长度 in 的 90% 以上就会调用 h，
+// h 在发送消息的 goroutine 中调用，不能阻塞，也不能在其中发送消息，h 为 nil 时不再检查
+// 需要在开始发送消息之前设置
+func (c *Conn) SetPoorCompressionHandler(h func(in, out int)) {
+	c.poorCompression = h
+}
+
+// 压缩效果很差时调用 SetPoorCompressionHandler 设置的回调
+func (c *Conn) checkCompressionRatio(in, out int) {
+	if c.poorCompression != nil && in > 0 && float64(out) >= float64(in)*poorCompressionRatio {
+		c.poorCompression(in, out)
+	}
+}
+
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, negotiatedCompression.Level)
+		return w
+	},
+}
+
+// 从客户端在 Sec-WebSocket-Extensions 中提供的扩展里选择服务端要启用的压缩扩展，返回要在响应中返回的扩展
+// 扩展之间以逗号分隔，扩展的参数以分号分隔，客户端按照偏好的顺序列出扩展，参见 RFC 6455 9.1，
+// 所以按顺序选择第一个服务端支持并且参数都能满足的，同一个扩展也可以以不同的参数提供多次
+// 选择了 x-deflate-dictionary 时同时返回使用的字典，没有可以接受的扩展时返回空字符串
+func (u *Upgrader) selectCompression(r *http.Request) (string, *CompressionDictionary) {
+	for _, offer := range headerTokens(r.Header, "Sec-Websocket-Extensions") {
+		_, params, _ := strings.Cut(offer, ";")
+		ext := parseExtension(offer)
+		switch {
+		case u.EnableCompression && ext.Name == compressionExtension && acceptsCompressionParams(params):
+			return compressionResponse, nil
+		case u.CompressionDictionary.matches(ext):
+			return u.CompressionDictionary.extension(), u.CompressionDictionary
+		}
+	}
+	return "", nil
+}
+
+// 判断一个 permessage-deflate 提议的参数能否被满足，参见 RFC 7692 7.1
+// compress/flate 总是使用 32K 的滑动窗口，所以 server_max_window_bits 小于 15 时无法满足，必须拒绝这个提议
+// client_max_window_bits 只是表示客户端可以接受更小的窗口，响应中不带它时客户端使用 15，所以总是可以接受
+// 出现未知的参数、重复的参数或者不合法的值时也要拒绝这个提议
+func acceptsCompressionParams(params string) bool {
+	seen := make(map[string]bool)
+	for _, param := range strings.Split(params, ";") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(param, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), "\"")
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if hasValue {
+				return false
+			}
+		case "server_max_window_bits":
+			if value != "15" {
+				return false
+			}
+		case "client_max_window_bits":
+			if hasValue && !isWindowBits(value) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// 判断服务端在响应中给出的 permessage-deflate 参数能否被客户端满足，参见 RFC 7692 7.1
+// 客户端的解压器不保留上下文，所以服务端必须接受 server_no_context_takeover，
+// 客户端没有提供 client_max_window_bits，服务端不能限制客户端的窗口，server_max_window_bits 则只影响服务端自己
+func acceptsCompressionResponse(params map[string]string) bool {
+	if _, ok := params["server_no_context_takeover"]; !ok {
+		return false
+	}
+	for name, value := range params {
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if value != "" {
+				return false
+			}
+		case "server_max_window_bits":
+			if !isWindowBits(value) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// 客户端根据服务端接受的 permessage-deflate 参数得到的压缩参数
+// 客户端每条消息都会重置压缩器，所以不管服务端有没有要求 client_no_context_takeover 都不保留上下文
+func clientCompressionInfo(params map[string]string) CompressionInfo {
+	info := negotiatedCompression
+	if bits, ok := params["server_max_window_bits"]; ok {
+		info.ServerMaxWindowBits, _ = strconv.Atoi(bits)
+	}
+	return info
+}
+
+// 判断是否是 8 到 15 之间的窗口大小
+func isWindowBits(s string) bool {
+	switch s {
+	case "8", "9", "10", "11", "12", "13", "14", "15":
+		return true
+	}
+	return false
+}
+
+// 取出一个压缩器，dict 不为 nil 时压缩器以 dict 作为初始的滑动窗口，Reset 之后仍然保留这个字典
+func getFlateWriter(dict *CompressionDictionary) *flate.Writer {
+	if dict != nil {
+		return dict.pool.Get().(*flate.Writer)
+	}
+	return flateWriterPool.Get().(*flate.Writer)
+}
+
+// 放回 getFlateWriter 取出的压缩器
+func putFlateWriter(dict *CompressionDictionary, fw *flate.Writer) {
+	if dict != nil {
+		dict.pool.Put(fw)
+		return
+	}
+	flateWriterPool.Put(fw)
+}
+
+// 压缩一条完整的消息，返回的数据已经去掉了末尾的 4 个字节，dict 为 nil 时不使用字典
+func compressData(data []byte, dict *CompressionDictionary) []byte {
+	var buf bytes.Buffer
+	fw := getFlateWriter(dict)
+	fw.Reset(&buf)
+	fw.Write(data)
+	fw.Flush()
+	putFlateWriter(dict, fw)
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail)
+}
+
+// 返回解压一条压缩消息的 reader，dict 必须和压缩这条消息时使用的字典相同
+func newInflater(r io.Reader, dict *CompressionDictionary) io.ReadCloser {
+	r = io.MultiReader(r, bytes.NewReader(inflateTail))
+	if dict != nil {
+		return flate.NewReaderDict(r, dict.data)
+	}
+	return flate.NewReader(r)
+}
+
+// 解压一条完整的消息，limit 大于 0 时解压后的长度超过 limit 会返回 ErrMessageTooBig，
+// 不会为了一个很小的压缩包分配出巨大的内存
+func decompressData(p []byte, limit int64, dict *CompressionDictionary) ([]byte, error) {
+	fr := newInflater(bytes.NewReader(p), dict)
+	defer fr.Close()
+
+	var r io.Reader = fr
+	if limit > 0 {
+		r = io.LimitReader(fr, limit+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, ErrMessageTooBig
+	}
+	return data, nil
+}
+
+// 把 flate.Writer 输出的数据写入 messageWriter，始终留住最后 4 个字节不写出，
+// 这样消息结束时就可以丢掉同步刷新产生的 0x00 0x00 0xff 0xff
+type truncWriter struct {
+	w       *messageWriter
+	tail    [4]byte
+	n       int // tail 中已有的字节数
+	written int // 已经写出的压缩数据的长度
+}
+
+func (t *truncWriter) Write(p []byte) (int, error) {
+	total := len(p)
+
+	// tail 还没有填满时先填 tail
+	if t.n < len(t.tail) {
+		k := copy(t.tail[t.n:], p)
+		t.n += k
+		p = p[k:]
+		if len(p) == 0 {
+			return total, nil
+		}
+	}
+
+	// 写出 tail 和 p 拼接之后除了最后 4 个字节之外的部分，把最后 4 个字节留在 tail 中
+	m := len(p)
+	if m > len(t.tail) {
+		m = len(t.tail)
+	}
+	if err := t.w.writeRaw(t.tail[:m]); err != nil {
+		return 0, err
+	}
+	copy(t.tail[:], t.tail[m:])
+	if err := t.w.writeRaw(p[:len(p)-m]); err != nil {
+		return 0, err
+	}
+	t.written += len(p)
+	copy(t.tail[len(t.tail)-m:], p[len(p)-m:])
+	return total, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressionInfo(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{EnableCompression: true})
+	resp, _, _ := rawHandshake(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	if got := resp.Header.Get("Sec-WebSocket-Extensions"); got != compressionResponse {
+		t.Fatalf("Sec-WebSocket-Extensions = %q, want %q", got, compressionResponse)
+	}
+
+	c := <-conns
+	defer c.Close()
+	want := CompressionInfo{
+		Enabled:                 true,
+		ServerNoContextTakeover: true,
+		ClientNoContextTakeover: true,
+		ServerMaxWindowBits:     15,
+		ClientMaxWindowBits:     15,
+		Level:                   flate.BestSpeed,
+	}
+	if got := c.CompressionInfo(); got != want {
+		t.Fatalf("CompressionInfo() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCompressionInfoNotNegotiated(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{EnableCompression: true})
+	resp, _, _ := rawHandshake(t, addr, "")
+	if got := resp.Header.Get("Sec-WebSocket-Extensions"); got != "" {
+		t.Fatalf("Sec-WebSocket-Extensions = %q, want none", got)
+	}
+
+	c := <-conns
+	defer c.Close()
+	if got := c.CompressionInfo(); got != (CompressionInfo{}) {
+		t.Fatalf("CompressionInfo() = %+v, want zero value", got)
+	}
+}
+
+func TestPoorCompressionHandler(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	c.compression = true
+	type event struct{ in, out int }
+	var events []event
+	c.SetPoorCompressionHandler(func(in, out int) {
+		events = append(events, event{in, out})
+	})
+	go io.Copy(io.Discard, peer)
+
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	if err := c.SendBinary(random); err != nil {
+		t.Fatalf("SendBinary() error = %v", err)
+	}
+	if len(events) != 1 || events[0].in != len(random) || events[0].out < len(random)*9/10 {
+		t.Fatalf("events after random payload = %+v, want one event with in = %d", events, len(random))
+	}
+
+	// 容易压缩的数据不会触发回调
+	if err := c.SendData(bytes.Repeat([]byte("hello "), 1000)); err != nil {
+		t.Fatalf("SendData() error = %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("events after compressible payload = %+v, want no new event", events)
+	}
+
+	// 流式写入的消息在 Close 时检查
+	w, err := c.NextWriter(BinaryMessage)
+	if err != nil {
+		t.Fatalf("NextWriter() error = %v", err)
+	}
+	w.Write(random[:2048])
+	w.Write(random[2048:])
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if len(events) != 2 || events[1].in != len(random) || events[1].out < len(random)*9/10 {
+		t.Fatalf("events after streamed payload = %+v, want a second event with in = %d", events, len(random))
+	}
+}
+
+func TestCompressedFrameBytes(t *testing.T) {
+	msg := bytes.Repeat([]byte("compressible "), 100)
+	writes := []struct {
+		name  string
+		write func(c *Conn) error
+	}{
+		{"SendData", func(c *Conn) error { return c.SendData(msg) }},
+		{"NextWriter", func(c *Conn) error {
+			w, err := c.NextWriter(TextMessage)
+			if err != nil {
+				return err
+			}
+			w.Write(msg)
+			return w.Close()
+		}},
+	}
+	for _, w := range writes {
+		c, rc := newRecordConn(true)
+		c.compression = true
+		if err := w.write(c); err != nil {
+			t.Fatalf("%s error = %v", w.name, err)
+		}
+		raw := rc.buf.Bytes()
+		if raw[0] != finalBit|rsv1Bit|TextMessage {
+			t.Fatalf("%s: first header byte = %#x, want FIN, RSV1 and text", w.name, raw[0])
+		}
+		if len(raw) >= len(msg) {
+			t.Fatalf("%s: wrote %d bytes for a %d-byte message", w.name, len(raw), len(msg))
+		}
+		if raw[1] != byte(len(raw)-2) {
+			t.Fatalf("%s: second header byte = %#x, want a %d-byte unmasked payload", w.name, raw[1], len(raw)-2)
+		}
+		if data, err := decompressData(raw[2:], 0, nil); err != nil || !bytes.Equal(data, msg) {
+			t.Fatalf("%s: decompressed %d bytes, %v", w.name, len(data), err)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// 测试中客户端使用的 mask key
+var testMaskKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// 组装一个客户端发送的帧，b0 是帧头的第一个字节（FIN、RSV 和 opcode），payload 会使用 testMaskKey 掩码
+func clientFrame(b0 byte, payload []byte) []byte {
+	return buildTestFrame(b0, true, payload)
+}
+
+// 组装一个帧，masked 为 false 时不带 mask key，用于模拟服务端发送的帧或者不合法的客户端帧
+func buildTestFrame(b0 byte, masked bool, payload []byte) []byte {
+	var out []byte
+	out = append(out, b0)
+
+	var b1 byte
+	if masked {
+		b1 = maskBit
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		out = append(out, b1|byte(n))
+	case n <= 65535:
+		out = append(out, b1|126)
+		out = binary.BigEndian.AppendUint16(out, uint16(n))
+	default:
+		out = append(out, b1|127)
+		out = binary.BigEndian.AppendUint64(out, uint64(n))
+	}
+
+	p := append([]byte(nil), payload...)
+	if masked {
+		out = append(out, testMaskKey[:]...)
+		maskBytes(testMaskKey, 0, p)
+	}
+	return append(out, p...)
+}
+
+// 对端发送的一个帧
+type testFrame struct {
+	b0      byte
+	payload []byte
+}
+
+func (f testFrame) opcode() int { return int(f.b0 & opCodeMask) }
+
+// 读取一个帧，带掩码时会解除掩码
+func readTestFrame(r io.Reader) (testFrame, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return testFrame{}, err
+	}
+	length := int64(b[1] & payloadLenMask)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return testFrame{}, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return testFrame{}, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	var key [4]byte
+	if b[1]&maskBit != 0 {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return testFrame{}, err
+		}
+	}
+	p := make([]byte, length)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return testFrame{}, err
+	}
+	if b[1]&maskBit != 0 {
+		maskBytes(key, 0, p)
+	}
+	return testFrame{b0: b[0], payload: p}, nil
+}
+
+// 创建一对通过 net.Pipe 连接的服务端 Conn 和客户端的原始连接
+func newTestServerConn() (*Conn, net.Conn) {
+	a, b := net.Pipe()
+	return newConn(a, bufio.NewReader(a), true), b
+}
+
+// 创建一对通过 net.Pipe 连接的服务端 Conn 和客户端 Conn
+func newTestConnPair() (server *Conn, client *Conn) {
+	a, b := net.Pipe()
+	return newConn(a, bufio.NewReader(a), true), newConn(b, bufio.NewReader(b), false)
+}
+
+// 创建一对通过本地 TCP 连接的服务端 Conn 和客户端 Conn
+// 和 net.Pipe 不同，TCP 连接有内核缓冲区，两端可以同时先写再读
+func newTCPConnPair(t testing.TB) (server *Conn, client *Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			conn = nil
+		}
+		accepted <- conn
+	}()
+	b, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := <-accepted
+	if a == nil {
+		t.Fatal("accept failed")
+	}
+	server, client = newConn(a, bufio.NewReader(a), true), newConn(b, bufio.NewReader(b), false)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+// 在后台把 frames 依次写给服务端，同时收集服务端写回的所有帧
+// 返回的函数会关闭客户端连接并返回收集到的帧
+func runTestPeer(peer net.Conn, frames [][]byte) func() []testFrame {
+	go func() {
+		for _, f := range frames {
+			if _, err := peer.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan []testFrame, 1)
+	go func() {
+		var got []testFrame
+		for {
+			f, err := readTestFrame(peer)
+			if err != nil {
+				done <- got
+				return
+			}
+			got = append(got, f)
+		}
+	}()
+
+	return func() []testFrame {
+		peer.Close()
+		return <-done
+	}
+}
+
+// 从服务端写回的帧中找出 close 帧的状态码，没有 close 帧时返回 -1，close 帧没有状态码时返回 CloseNoStatusReceived
+func closeCodeOf(frames []testFrame) int {
+	for _, f := range frames {
+		if f.opcode() == CloseMessage {
+			code, _ := parseClosePayload(f.payload)
+			return int(code)
+		}
+	}
+	return -1
+}
+
+func TestConformance(t *testing.T) {
+	type message struct {
+		typ  int
+		data string
+	}
+
+	const (
+		fin  = finalBit
+		text = TextMessage
+		bin  = BinaryMessage
+		cont = ContinuationFrame
+	)
+
+	cases := []struct {
+		name   string
+		frames [][]byte
+		want   []message // 依次读到的消息
+		// 读完 want 之后下一次读取返回的错误，为 nil 时要求读到状态码为 close 的 CloseError
+		// 为 io.EOF 时表示消息都正常读完，客户端最后会再发送一个 1000 的 close 帧，服务端要回应 1000
+		err   error
+		close int      // 服务端发送的 close 帧的状态码
+		pongs []string // 服务端回复的 pong
+	}{
+		{
+			name:   "single text frame",
+			frames: [][]byte{clientFrame(fin|text, []byte("Hello"))},
+			want:   []message{{text, "Hello"}},
+			err:    io.EOF,
+		},
+		{
+			name:   "single binary frame",
+			frames: [][]byte{clientFrame(fin|bin, []byte{0x00, 0xff, 0x80})},
+			want:   []message{{bin, "\x00\xff\x80"}},
+			err:    io.EOF,
+		},
+		{
+			name:   "empty text frame",
+			frames: [][]byte{clientFrame(fin|text, nil)},
+			want:   []message{{text, ""}},
+			err:    io.EOF,
+		},
+		{
+			name:   "payload length 125",
+			frames: [][]byte{clientFrame(fin|bin, bytes.Repeat([]byte{'a'}, 125))},
+			want:   []message{{bin, strings.Repeat("a", 125)}},
+			err:    io.EOF,
+		},
+		{
+			name:   "payload length 126 uses 16-bit length",
+			frames: [][]byte{clientFrame(fin|bin, bytes.Repeat([]byte{'b'}, 126))},
+			want:   []message{{bin, strings.Repeat("b", 126)}},
+			err:    io.EOF,
+		},
+		{
+			name:   "payload length 65535 uses 16-bit length",
+			frames: [][]byte{clientFrame(fin|bin, bytes.Repeat([]byte{'c'}, 65535))},
+			want:   []message{{bin, strings.Repeat("c", 65535)}},
+			err:    io.EOF,
+		},
+		{
+			name:   "payload length 65536 uses 64-bit length",
+			frames: [][]byte{clientFrame(fin|bin, bytes.Repeat([]byte{'d'}, 65536))},
+			want:   []message{{bin, strings.Repeat("d", 65536)}},
+			err:    io.EOF,
+		},
+		{
+			name:   "64-bit length with the high bit set",
+			frames: [][]byte{{fin | bin, maskBit | 127, 0x80, 0, 0, 0, 0, 0, 0, 1}},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name: "fragmented text message",
+			frames: [][]byte{
+				clientFrame(text, []byte("frag")),
+				clientFrame(cont, []byte("ment")),
+				clientFrame(fin|cont, []byte("ed")),
+			},
+			want: []message{{text, "fragmented"}},
+			err:  io.EOF,
+		},
+		{
+			name: "fragmented message with empty fragments",
+			frames: [][]byte{
+				clientFrame(bin, nil),
+				clientFrame(cont, []byte("x")),
+				clientFrame(fin|cont, nil),
+			},
+			want: []message{{bin, "x"}},
+			err:  io.EOF,
+		},
+		{
+			name: "ping between fragments",
+			frames: [][]byte{
+				clientFrame(text, []byte("a")),
+				clientFrame(fin|PingMessage, []byte("ping")),
+				clientFrame(fin|cont, []byte("b")),
+			},
+			want:  []message{{text, "ab"}},
+			err:   io.EOF,
+			pongs: []string{"ping"},
+		},
+		{
+			name: "unsolicited pong is ignored",
+			frames: [][]byte{
+				clientFrame(fin|PongMessage, []byte("x")),
+				clientFrame(fin|text, []byte("after pong")),
+			},
+			want: []message{{text, "after pong"}},
+			err:  io.EOF,
+		},
+		{
+			name:   "continuation without a started message",
+			frames: [][]byte{clientFrame(fin|cont, []byte("x"))},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name: "new data frame inside a fragmented message",
+			frames: [][]byte{
+				clientFrame(text, []byte("a")),
+				clientFrame(fin|text, []byte("b")),
+			},
+			err:   ErrProtocol,
+			close: CloseProtocolError,
+		},
+		{
+			name:   "ping with 125 bytes payload",
+			frames: [][]byte{clientFrame(fin|PingMessage, bytes.Repeat([]byte{'p'}, 125))},
+			err:    io.EOF,
+			pongs:  []string{strings.Repeat("p", 125)},
+		},
+		{
+			name:   "ping with 126 bytes payload",
+			frames: [][]byte{clientFrame(fin|PingMessage, bytes.Repeat([]byte{'p'}, 126))},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name:   "fragmented ping",
+			frames: [][]byte{clientFrame(PingMessage, []byte("x"))},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name:   "close with status code",
+			frames: [][]byte{clientFrame(fin|CloseMessage, closePayload(CloseNormalClosure, "bye"))},
+			close:  CloseNormalClosure,
+		},
+		{
+			name:   "close with custom status code",
+			frames: [][]byte{clientFrame(fin|CloseMessage, closePayload(4000, ""))},
+			close:  4000,
+		},
+		{
+			name:   "close without payload",
+			frames: [][]byte{clientFrame(fin|CloseMessage, nil)},
+			close:  CloseNoStatusReceived,
+		},
+		{
+			name:   "close with 1 byte payload",
+			frames: [][]byte{clientFrame(fin|CloseMessage, []byte{0x03})},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name: "data after close is ignored",
+			frames: [][]byte{
+				clientFrame(fin|CloseMessage, closePayload(CloseGoingAway, "")),
+				clientFrame(fin|text, []byte("ignored")),
+			},
+			close: CloseGoingAway,
+		},
+		{
+			name:   "valid multibyte text",
+			frames: [][]byte{clientFrame(fin|text, []byte("κόσμε€😀"))},
+			want:   []message{{text, "κόσμε€😀"}},
+			err:    io.EOF,
+		},
+		{
+			name: "character split across fragments",
+			frames: [][]byte{
+				clientFrame(text, []byte("\xe2\x82")),
+				clientFrame(fin|cont, []byte("\xac")),
+			},
+			want: []message{{text, "€"}},
+			err:  io.EOF,
+		},
+		{
+			name:   "invalid utf-8 text",
+			frames: [][]byte{clientFrame(fin|text, []byte("\xce\xba\xe1\xbd"))},
+			err:    ErrInvalidUTF8,
+			close:  CloseInvalidFramePayloadData,
+		},
+		{
+			name: "invalid utf-8 in the last fragment",
+			frames: [][]byte{
+				clientFrame(text, []byte("ok")),
+				clientFrame(fin|cont, []byte{0xc0, 0xaf}),
+			},
+			err:   ErrInvalidUTF8,
+			close: CloseInvalidFramePayloadData,
+		},
+		{
+			name:   "invalid utf-8 in binary is accepted",
+			frames: [][]byte{clientFrame(fin|bin, []byte{0xc0, 0xaf})},
+			want:   []message{{bin, "\xc0\xaf"}},
+			err:    io.EOF,
+		},
+		{
+			name:   "rsv1 without extension",
+			frames: [][]byte{clientFrame(fin|rsv1Bit|text, []byte("x"))},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name:   "rsv2",
+			frames: [][]byte{clientFrame(fin|rsv2Bit|text, []byte("x"))},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name:   "rsv3 on a ping",
+			frames: [][]byte{clientFrame(fin|rsv3Bit|PingMessage, nil)},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name:   "reserved data opcode",
+			frames: [][]byte{clientFrame(fin|3, []byte("x"))},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name:   "reserved control opcode",
+			frames: [][]byte{clientFrame(fin|0x0b, nil)},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name:   "unmasked client frame",
+			frames: [][]byte{buildTestFrame(fin|text, false, []byte("x"))},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+		{
+			name:   "masked first fragment then unmasked continuation",
+			frames: [][]byte{clientFrame(text, []byte("Hel")), buildTestFrame(fin|cont, false, []byte("lo"))},
+			err:    ErrProtocol,
+			close:  CloseProtocolError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			frames, wantErr, wantClose := tc.frames, tc.err, tc.close
+			if wantErr == io.EOF {
+				frames = append(frames[:len(frames):len(frames)], clientFrame(fin|CloseMessage, closePayload(CloseNormalClosure, "")))
+				wantErr, wantClose = nil, CloseNormalClosure
+			}
+
+			c, peer := newTestServerConn()
+			defer c.Close()
+			finish := runTestPeer(peer, frames)
+
+			for _, want := range tc.want {
+				typ, data, err := c.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage() error = %v, want %q", err, want.data)
+				}
+				if typ != want.typ || string(data) != want.data {
+					t.Fatalf("ReadMessage() = %d, %q, want %d, %q", typ, data, want.typ, want.data)
+				}
+			}
+
+			_, _, err := c.ReadMessage()
+			if wantErr == nil {
+				var ce *CloseError
+				if !errors.As(err, &ce) {
+					t.Fatalf("ReadMessage() error = %v, want *CloseError", err)
+				}
+				if int(ce.Code) != wantClose {
+					t.Errorf("CloseError.Code = %d, want %d", ce.Code, wantClose)
+				}
+			} else if !errors.Is(err, wantErr) {
+				t.Fatalf("ReadMessage() error = %v, want %v", err, wantErr)
+			}
+			checkTestFrames(t, finish(), wantClose, tc.pongs)
+		})
+	}
+}
+
+func checkTestFrames(t *testing.T, frames []testFrame, wantClose int, wantPongs []string) {
+	t.Helper()
+	if got := closeCodeOf(frames); got != wantClose {
+		t.Errorf("close code sent = %d, want %d", got, wantClose)
+	}
+	var pongs []string
+	for _, f := range frames {
+		if f.opcode() == PongMessage {
+			pongs = append(pongs, string(f.payload))
+		}
+	}
+	if strings.Join(pongs, ",") != strings.Join(wantPongs, ",") {
+		t.Errorf("pongs sent = %q, want %q", pongs, wantPongs)
+	}
+}
+
+func TestClientRejectsMaskedContinuation(t *testing.T) {
+	a, peer := net.Pipe()
+	c := newConn(a, bufio.NewReader(a), false)
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{
+		buildTestFrame(TextMessage, false, []byte("Hel")),
+		buildTestFrame(finalBit|ContinuationFrame, true, []byte("lo")),
+	})
+
+	if _, _, err := c.ReadMessage(); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("ReadMessage() error = %v, want ErrProtocol", err)
+	}
+	if got := closeCodeOf(finish()); got != CloseProtocolError {
+		t.Fatalf("close code sent = %d, want %d", got, CloseProtocolError)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestContextDoneAfterClose(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer peer.Close()
+
+	if err := c.Context().Err(); err != nil {
+		t.Fatalf("Context().Err() = %v before Close", err)
+	}
+	c.Close()
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not done after Close")
+	}
+}
+
+func TestContextDoneWhenPeerDisconnects(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		c, peer := newTestServerConn()
+		peer.Close()
+
+		var err error
+		if stream {
+			_, _, err = c.NextReader()
+		} else {
+			_, err = c.ReadData()
+		}
+		if err == nil {
+			t.Fatal("read succeeded after peer disconnected")
+		}
+		select {
+		case <-c.Context().Done():
+		case <-time.After(time.Second):
+			t.Fatalf("stream=%v: context not done after read error %v", stream, err)
+		}
+		c.Close()
+	}
+}
+
+func TestContextDoneWhenPeerDisconnectsBetweenFragments(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	go func() {
+		peer.Write(clientFrame(TextMessage, []byte("part")))
+		peer.Close()
+	}()
+
+	_, r, err := c.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readInChunks(r, 16); err == nil {
+		t.Fatal("Read() succeeded although the message was cut off")
+	}
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not done after the peer disconnected")
+	}
+}
+
+func TestReadLoop(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|TextMessage, []byte("one")),
+		clientFrame(finalBit|BinaryMessage, []byte("two")),
+		clientFrame(finalBit|TextMessage, []byte("three")),
+		clientFrame(finalBit|CloseMessage, closePayload(CloseNormalClosure, "")),
+	})
+	defer finish()
+
+	messages, errc := c.ReadLoop()
+	want := []Message{{TextMessage, []byte("one")}, {BinaryMessage, []byte("two")}, {TextMessage, []byte("three")}}
+	var got []Message
+	for m := range messages {
+		got = append(got, m)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("messages = %+v, want %+v", got, want)
+	}
+	var closeErr *CloseError
+	if err := <-errc; !errors.As(err, &closeErr) || closeErr.Code != CloseNormalClosure {
+		t.Fatalf("error = %v, want close 1000", err)
+	}
+}
+
+func TestReadLoopExitsWhenConnClosed(t *testing.T) {
+	c, peer := newTestServerConn()
+	frames := c.DebugFrames()
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|TextMessage, []byte("one")),
+		clientFrame(finalBit|TextMessage, []byte("two")),
+	})
+	defer finish()
+
+	// 只消费第一条消息，等第二条消息读出来之后关闭连接，读取 goroutine 不能一直阻塞在投递它上
+	messages, errc := c.ReadLoop()
+	if m := <-messages; string(m.Data) != "one" {
+		t.Fatalf("first message = %q, want %q", m.Data, "one")
+	}
+	<-frames
+	<-frames
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("error = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadLoop goroutine did not exit after Close")
+	}
+	if _, ok := <-messages; ok {
+		t.Fatal("messages channel is still open")
+	}
+}
+
+func TestReadDeadlineTimeout(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	start := time.Now()
+	c.SetReadDeadline(start.Add(50 * time.Millisecond))
+	_, err := c.ReadData()
+	elapsed := time.Since(start)
+
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("ReadData() error = %v, want a timeout", err)
+	}
+	if elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("ReadData() returned after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestReadDataContextCancelMidRead(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	// 对端只发送帧头和一半的 payload，读取会停在 payload 的中间
+	frame := clientFrame(finalBit|TextMessage, []byte("half of this message"))
+	go peer.Write(frame[:len(frame)-10])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := c.ReadDataContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("ReadDataContext() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("ReadDataContext() returned %v after cancel", elapsed)
+	}
+	// 连接停在帧的中间，已经被关闭
+	if c.Context().Err() == nil {
+		t.Fatal("connection not closed after a cancelled read")
+	}
+}
+
+func TestPingHandler(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	var got []string
+	c.SetPingHandler(func(appData []byte) error {
+		got = append(got, string(appData))
+		return nil
+	})
+
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(0x89, []byte("p1")),
+		clientFrame(0x81, []byte("text")),
+	})
+	if data, err := c.ReadData(); err != nil || string(data) != "text" {
+		t.Fatalf("ReadData() = %q, %v, want %q", data, err, "text")
+	}
+	if len(got) != 1 || got[0] != "p1" {
+		t.Errorf("ping handler got %q, want [p1]", got)
+	}
+	// 设置了处理函数之后不再自动回复 pong
+	if frames := finish(); len(frames) != 0 {
+		t.Errorf("peer received %d frames, want none", len(frames))
+	}
+}
+
+func TestPingHandlerError(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	errPing := errors.New("ping rejected")
+	c.SetPingHandler(func(appData []byte) error { return errPing })
+
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(0x89, nil),
+		clientFrame(0x81, []byte("text")),
+	})
+	defer finish()
+	if _, err := c.ReadData(); err != errPing {
+		t.Fatalf("ReadData() error = %v, want %v", err, errPing)
+	}
+}
+
+// 记录每次设置的读写超时，再交给被包装的连接
+type deadlineConn struct {
+	net.Conn
+	mu     sync.Mutex
+	reads  []time.Time
+	writes []time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.reads = append(c.reads, t)
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writes = append(c.writes, t)
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func TestDeadlineFuncProgressivelyShorter(t *testing.T) {
+	a, peer := net.Pipe()
+	dc := &deadlineConn{Conn: a}
+	c := newConn(dc, bufio.NewReader(dc), true)
+	defer c.Close()
+
+	// 每次调用返回的超时都比上一次短，最后一次已经过去
+	base := time.Now()
+	timeouts := []time.Duration{10 * time.Second, 5 * time.Second, time.Second, -time.Second}
+	var returned []time.Time
+	c.SetDeadlineFunc(func(write bool) time.Time {
+		d := base.Add(timeouts[len(returned)])
+		returned = append(returned, d)
+		return d
+	})
+
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|TextMessage, []byte("one")),
+		clientFrame(finalBit|TextMessage, []byte("two")),
+	})
+	defer finish()
+	for _, want := range []string{"one", "two"} {
+		if data, err := c.ReadData(); err != nil || string(data) != want {
+			t.Fatalf("ReadData() = %q, %v, want %q", data, err, want)
+		}
+	}
+	if err := c.SendData([]byte("reply")); err != nil {
+		t.Fatalf("SendData() error = %v", err)
+	}
+	// 最后一次返回的超时已经过去，读取应该立即超时
+	_, err := c.ReadData()
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("ReadData() error = %v, want timeout", err)
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	applied := []time.Time{dc.reads[0], dc.reads[1], dc.writes[0], dc.reads[2]}
+	if !reflect.DeepEqual(applied, returned) {
+		t.Errorf("applied deadlines %v, want %v", applied, returned)
+	}
+}
+
+func TestStateAcrossGoroutines(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	if _, ok := c.GetState("missing"); ok {
+		t.Fatal("GetState() of a missing key ok = true")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			for j := 0; j < 100; j++ {
+				c.SetState(key, j)
+				c.GetState(fmt.Sprintf("key-%d", (i+1)%8))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		if v, ok := c.GetState(fmt.Sprintf("key-%d", i)); !ok || v != 99 {
+			t.Errorf("GetState(key-%d) = %v, %v, want 99", i, v, ok)
+		}
+	}
+}
+
+func TestAgeIncreases(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	first := c.Age()
+	time.Sleep(20 * time.Millisecond)
+	if second := c.Age(); second-first < 20*time.Millisecond {
+		t.Fatalf("Age() went from %v to %v after 20ms", first, second)
+	}
+	if c.UpgradedAt().After(time.Now()) {
+		t.Fatalf("UpgradedAt() = %v is in the future", c.UpgradedAt())
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+// 一个帧的元数据，用于调试
+type FrameInfo struct {
+	Opcode     int
+	Fin        bool
+	Length     int64
+	Masked     bool
+	Compressed bool // RSV1 位是否被设置
+}
+
+// 调试用的帧元数据 channel 的缓冲大小
+const debugFramesBuffer = 64
+
+// 开启帧调试并返回接收帧元数据的 channel，之后每读取到一个帧都会发送一份它的元数据
+// channel 满了（没有人及时读取）时新的元数据会被直接丢弃，不会阻塞读取
+func (c *Conn) DebugFrames() <-chan FrameInfo {
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+	if c.debugFrames == nil {
+		c.debugFrames = make(chan FrameInfo, debugFramesBuffer)
+	}
+	return c.debugFrames
+}
+
+func (c *Conn) emitFrameInfo(info FrameInfo) {
+	c.debugMu.Lock()
+	ch := c.debugFrames
+	c.debugMu.Unlock()
+	if ch == nil {
+		return
+	}
+
+	select {
+	case ch <- info:
+	default:
+	}
+}
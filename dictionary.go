@@ -0,0 +1,52 @@
+package main
+
+import (
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// 使用共享压缩字典的私有扩展，不是 RFC 7692 定义的扩展
+const dictionaryExtension = "x-deflate-dictionary"
+
+// 使用字典时的压缩级别，compress/flate 在更低的级别下压缩很短的消息时不会去字典中查找匹配
+const dictionaryCompressionLevel = flate.BestCompression
+
+// 服务端和客户端预先约定的压缩字典，所有消息结构相似时可以明显提高短消息的压缩率，见 Upgrader.CompressionDictionary
+// 通过私有扩展 x-deflate-dictionary 协商，只有双方都使用这个包并且配置了内容相同的字典时才能协商成功
+// 压缩方式和 permessage-deflate 相同，同样使用 RSV1 位、不保留上下文，只是每条消息的压缩和解压都以字典作为初始的滑动窗口，
+// 只有字典的最后 32K 字节会被使用
+// 字典创建之后不会再被修改，可以同时被任意多个连接使用
+type CompressionDictionary struct {
+	id   string
+	data []byte
+	pool sync.Pool // 以这个字典初始化的 *flate.Writer
+}
+
+// 创建共享压缩字典，dict 会被复制，之后修改 dict 不会影响字典
+func NewCompressionDictionary(dict []byte) *CompressionDictionary {
+	d := &CompressionDictionary{data: append([]byte(nil), dict...)}
+	sum := sha256.Sum256(d.data)
+	d.id = hex.EncodeToString(sum[:8])
+	d.pool.New = func() interface{} {
+		w, _ := flate.NewWriterDict(nil, dictionaryCompressionLevel, d.data)
+		return w
+	}
+	return d
+}
+
+// 返回字典的 id，即字典内容的 sha256 的前 8 个字节，握手时双方用它确认使用的是同一个字典
+func (d *CompressionDictionary) ID() string {
+	return d.id
+}
+
+// 握手时提供和返回的扩展
+func (d *CompressionDictionary) extension() string {
+	return dictionaryExtension + "; id=" + d.id
+}
+
+// 判断 ext 是否是使用这个字典的 x-deflate-dictionary，d 为 nil 时总是返回 false
+func (d *CompressionDictionary) matches(ext Extension) bool {
+	return d != nil && ext.Name == dictionaryExtension && len(ext.Params) == 1 && ext.Params["id"] == d.id
+}
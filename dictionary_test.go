@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCompressionDictionarySharedAcrossConns(t *testing.T) {
+	raw := []byte(`{"type":"quote","symbol":"","price":0,"volume":0,"exchange":""}`)
+	dict := NewCompressionDictionary(raw)
+	// 字典复制了传入的数据，之后修改它不会影响已经创建的字典
+	for i := range raw {
+		raw[i] = 0
+	}
+
+	addr, conns := newUpgradeTestServer(t, &Upgrader{EnableCompression: true, CompressionDictionary: dict})
+	var clients, servers []*Conn
+	for i := 0; i < 2; i++ {
+		c, err := (&DialConfig{EnableCompression: true, CompressionDictionary: NewCompressionDictionary(dict.data)}).Dial("ws://"+addr+"/", nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer c.Close()
+		s := <-conns
+		defer s.Close()
+		if got := c.CompressionInfo().Dictionary; got != dict.ID() {
+			t.Fatalf("client CompressionInfo().Dictionary = %q, want %q", got, dict.ID())
+		}
+		if got := s.CompressionInfo().Dictionary; got != dict.ID() {
+			t.Fatalf("server CompressionInfo().Dictionary = %q, want %q", got, dict.ID())
+		}
+		clients = append(clients, c)
+		servers = append(servers, s)
+	}
+
+	// 两个连接同时使用同一个字典收发消息，客户端通过 WriteMessage 发送，服务端通过 NextWriter 回复
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(c, s *Conn, i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				msg := `{"type":"quote","symbol":"ACME","price":` + strings.Repeat("9", i+j) + `,"volume":1,"exchange":"X"}`
+				frames := s.DebugFrames()
+				go c.SendData([]byte(msg))
+				if _, data, err := s.ReadMessage(); err != nil || string(data) != msg {
+					t.Errorf("server ReadMessage() = %q, %v, want %q", data, err, msg)
+					return
+				}
+				if f := <-frames; !f.Compressed || f.Length >= int64(len(compressData([]byte(msg), nil))) {
+					t.Errorf("frame = %+v, want it shorter than without the dictionary", f)
+					return
+				}
+				go func() {
+					w, _ := s.NextWriter(TextMessage)
+					w.Write([]byte(msg))
+					w.Close()
+				}()
+				if _, data, err := c.ReadMessage(); err != nil || string(data) != msg {
+					t.Errorf("client ReadMessage() = %q, %v, want %q", data, err, msg)
+					return
+				}
+			}
+		}(clients[i], servers[i], i)
+	}
+	wg.Wait()
+}
+
+func TestCompressionDictionaryMismatch(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{EnableCompression: true, CompressionDictionary: NewCompressionDictionary([]byte("server"))})
+	c, err := (&DialConfig{EnableCompression: true, CompressionDictionary: NewCompressionDictionary([]byte("client"))}).Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	(<-conns).Close()
+
+	// 字典不同时退回到 permessage-deflate
+	info := c.CompressionInfo()
+	if !info.Enabled || info.Dictionary != "" {
+		t.Fatalf("CompressionInfo() = %+v, want permessage-deflate without a dictionary", info)
+	}
+}
+
+func TestExtensionOrderPreference(t *testing.T) {
+	dict := NewCompressionDictionary([]byte("shared dictionary"))
+	tests := []struct {
+		offer string
+		want  string
+	}{
+		{dict.extension() + ", " + compressionOffer, dict.extension()},
+		{compressionOffer + ", " + dict.extension(), compressionResponse},
+		// 不能满足的提议被跳过，选择下一个
+		{"permessage-deflate; server_max_window_bits=10, " + dict.extension(), dict.extension()},
+		{"x-unknown, " + compressionOffer, compressionResponse},
+	}
+	for _, tt := range tests {
+		addr, conns := newUpgradeTestServer(t, &Upgrader{EnableCompression: true, CompressionDictionary: dict})
+		resp, _, _ := rawHandshake(t, addr, "Sec-WebSocket-Extensions: "+tt.offer+"\r\n")
+		if got := resp.Header.Get("Sec-WebSocket-Extensions"); got != tt.want {
+			t.Errorf("offer %q: Sec-WebSocket-Extensions = %q, want %q", tt.offer, got, tt.want)
+		}
+		(<-conns).Close()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// 不给客户端的帧加掩码的私有扩展，违反了 RFC 6455 5.1 的要求，见 Upgrader.AllowNoMask 和 DialConfig.NoMask
+// 掩码用来防止恶意脚本通过浏览器污染中间代理的缓存，只有两端都由自己控制、中间没有代理的内网连接可以省掉它
+const noMaskExtension = "x-no-mask"
+
+// 握手时协商出的一个扩展，比如 permessage-deflate
+type Extension struct {
+	Name   string            // 扩展名，统一转换成小写
+	Params map[string]string // 扩展参数，参数名统一转换成小写，没有值的参数对应空字符串
+}
+
+// 解析 Sec-WebSocket-Extensions 请求头或响应头，同一个头出现多次时会合并起来，参见 RFC 6455 9.1
+// 扩展之间以逗号分隔，扩展的参数以分号分隔，参数值可以带引号
+func parseExtensions(headers http.Header) []Extension {
+	var exts []Extension
+	for _, token := range headerTokens(headers, "Sec-Websocket-Extensions") {
+		exts = append(exts, parseExtension(token))
+	}
+	return exts
+}
+
+// 解析单个扩展，比如 "permessage-deflate; client_max_window_bits=10"
+func parseExtension(s string) Extension {
+	name, params, _ := strings.Cut(s, ";")
+	ext := Extension{Name: strings.ToLower(strings.TrimSpace(name)), Params: make(map[string]string)}
+	for _, param := range strings.Split(params, ";") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(param, "=")
+		ext.Params[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), "\"")
+	}
+	return ext
+}
+
+// 判断客户端是否在 Sec-WebSocket-Extensions 中提供了不带参数的 x-no-mask
+func offersNoMask(r *http.Request) bool {
+	for _, ext := range parseExtensions(r.Header) {
+		if ext.Name == noMaskExtension && len(ext.Params) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回握手时双方协商出的扩展，没有协商任何扩展时为 nil
+// 通过 Dial 得到的连接是服务端在响应中选择的扩展，通过 Upgrade 得到的连接是服务端自己返回的扩展
+func (c *Conn) NegotiatedExtensions() []Extension {
+	return c.extensions
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestNoMaskNegotiated(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{AllowNoMask: true})
+	c, err := (&DialConfig{NoMask: true}).Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	server := <-conns
+	defer server.Close()
+
+	if exts := c.NegotiatedExtensions(); len(exts) != 1 || exts[0].Name != noMaskExtension {
+		t.Fatalf("client NegotiatedExtensions() = %+v, want x-no-mask", exts)
+	}
+	if exts := server.NegotiatedExtensions(); len(exts) != 1 || exts[0].Name != noMaskExtension {
+		t.Fatalf("server NegotiatedExtensions() = %+v, want x-no-mask", exts)
+	}
+
+	// 客户端发送不带掩码的帧，服务端照常接受
+	frames := server.DebugFrames()
+	for _, msg := range []string{"first", "second"} {
+		go c.WriteTextString(msg)
+		if _, data, err := server.ReadMessage(); err != nil || string(data) != msg {
+			t.Fatalf("server ReadMessage() = %q, %v, want %q", data, err, msg)
+		}
+		if f := <-frames; f.Masked {
+			t.Fatalf("frame = %+v, want unmasked", f)
+		}
+	}
+}
+
+func TestNoMaskRequiresBothEnds(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  bool
+		noMask bool
+	}{
+		{"server only", true, false},
+		{"client only", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, conns := newUpgradeTestServer(t, &Upgrader{AllowNoMask: tt.allow})
+			c, err := (&DialConfig{NoMask: tt.noMask}).Dial("ws://"+addr+"/", nil)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer c.Close()
+			server := <-conns
+			defer server.Close()
+
+			if exts := c.NegotiatedExtensions(); exts != nil {
+				t.Fatalf("NegotiatedExtensions() = %+v, want none", exts)
+			}
+			frames := server.DebugFrames()
+			go c.SendData([]byte("hello"))
+			if _, _, err := server.ReadMessage(); err != nil {
+				t.Fatalf("server ReadMessage() error = %v", err)
+			}
+			if f := <-frames; !f.Masked {
+				t.Fatalf("frame = %+v, want masked", f)
+			}
+		})
+	}
+}
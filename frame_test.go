@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// 创建一个从 data 中读取帧的服务端 Conn，只用于测试帧头的解析
+func newFrameReaderConn(data []byte) *Conn {
+	a, _ := net.Pipe()
+	return newConn(a, bufio.NewReader(bytes.NewReader(data)), true)
+}
+
+func TestReadFrameHeader64BitLength(t *testing.T) {
+	// 127 表示 64 位扩展长度，70000 = 0x0000000000011170，按大端序排列
+	header := []byte{finalBit | BinaryMessage, 127, 0, 0, 0, 0, 0, 0x01, 0x11, 0x70}
+	c := newFrameReaderConn(header)
+	defer c.Close()
+
+	h, err := c.readFrameHeader()
+	if err != nil {
+		t.Fatalf("readFrameHeader() error = %v", err)
+	}
+	if h.length != 70000 {
+		t.Fatalf("length = %d, want 70000", h.length)
+	}
+	if !h.final || h.opcode != BinaryMessage || h.masked {
+		t.Fatalf("header = %+v", h)
+	}
+}
+
+func TestReadMaskedExtendedLengthFrames(t *testing.T) {
+	for _, n := range []int{126, 65535, 70000} {
+		payload := make([]byte, n)
+		for i := range payload {
+			payload[i] = byte(i * 7)
+		}
+		c := newFrameReaderConn(clientFrame(finalBit|BinaryMessage, payload))
+
+		typ, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("length %d: ReadMessage() error = %v", n, err)
+		}
+		if typ != BinaryMessage || !bytes.Equal(data, payload) {
+			t.Fatalf("length %d: ReadMessage() = %d, %d bytes, payload mismatch", n, typ, len(data))
+		}
+		c.Close()
+	}
+}
+
+func TestReadFrameWrittenInSmallChunks(t *testing.T) {
+	payload := bytes.Repeat([]byte("chunked payload "), 20)
+	frame := clientFrame(finalBit|TextMessage, payload)
+
+	// 对端每次只写 3 个字节，帧头、扩展长度、mask key 和 payload 都会被拆在多次读取中
+	c, peer := newTestServerConn()
+	defer c.Close()
+	go func() {
+		for i := 0; i < len(frame); i += 3 {
+			end := i + 3
+			if end > len(frame) {
+				end = len(frame)
+			}
+			if _, err := peer.Write(frame[i:end]); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	defer peer.Close()
+
+	typ, data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if typ != TextMessage || !bytes.Equal(data, payload) {
+		t.Fatalf("ReadMessage() = %d, %q, want the whole payload", typ, data)
+	}
+}
+
+// 每次 Read 最多只返回一个字节的 net.Conn
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c oneByteConn) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return c.Conn.Read(p)
+}
+
+func TestReadOneBytePerRead(t *testing.T) {
+	a, peer := net.Pipe()
+	conn := oneByteConn{a}
+	c := newConn(conn, bufio.NewReader(conn), true)
+	defer c.Close()
+
+	long := bytes.Repeat([]byte{0xab}, 70000)
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|TextMessage, []byte("short")),
+		clientFrame(finalBit|BinaryMessage, bytes.Repeat([]byte{'m'}, 300)),
+		clientFrame(finalBit|BinaryMessage, long),
+		clientFrame(TextMessage, []byte("frag")),
+		clientFrame(finalBit|PingMessage, []byte("ping")),
+		clientFrame(finalBit|ContinuationFrame, []byte("mented")),
+	})
+	defer finish()
+
+	want := []struct {
+		typ  int
+		data []byte
+	}{
+		{TextMessage, []byte("short")},
+		{BinaryMessage, bytes.Repeat([]byte{'m'}, 300)},
+		{BinaryMessage, long},
+		{TextMessage, []byte("fragmented")},
+	}
+	for _, w := range want {
+		typ, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		if typ != w.typ || !bytes.Equal(data, w.data) {
+			t.Fatalf("ReadMessage() = %d, %d bytes, want %d, %d bytes", typ, len(data), w.typ, len(w.data))
+		}
+	}
+}
+
+// 帧头各个位和 opcode 的取值，参见 RFC 6455 5.2
+func TestFrameConstants(t *testing.T) {
+	tests := []struct {
+		name string
+		got  int
+		want int
+	}{
+		{"finalBit", finalBit, 0x80},
+		{"rsv1Bit", rsv1Bit, 0x40},
+		{"rsv2Bit", rsv2Bit, 0x20},
+		{"rsv3Bit", rsv3Bit, 0x10},
+		{"opCodeMask", opCodeMask, 0x0f},
+		{"maskBit", maskBit, 0x80},
+		{"payloadLenMask", payloadLenMask, 0x7f},
+		{"ContinuationFrame", ContinuationFrame, 0x0},
+		{"TextMessage", TextMessage, 0x1},
+		{"BinaryMessage", BinaryMessage, 0x2},
+		{"CloseMessage", CloseMessage, 0x8},
+		{"PingMessage", PingMessage, 0x9},
+		{"PongMessage", PongMessage, 0xA},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %#x, want %#x", tt.name, tt.got, tt.want)
+		}
+	}
+}
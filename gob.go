@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+)
+
+// 读到的消息不是二进制消息时 ReadGob 返回的错误
+var errNotBinaryMessage = errors.New("websocket: gob message is not a binary message")
+
+// 以 encoding/gob 编码 v 并作为一条二进制消息发送，适合两端都是 Go 程序的内部服务
+// 和 WriteJSON 一样编码结果直接写入帧，超过帧长度时会自动分片
+// 每条消息都使用新的 Encoder，类型信息会随每条消息一起发送，所以每条消息都可以单独被 ReadGob 解码
+func (c *Conn) WriteGob(v interface{}) error {
+	w, err := c.newMessageWriter(BinaryMessage, false)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(w).Encode(v); err != nil {
+		// 编码失败时 Encoder 不会写入任何数据，直接放弃这条消息
+		w.abort()
+		return err
+	}
+	return w.Close()
+}
+
+// 读取一条二进制消息并用 encoding/gob 解码到 v 中，v 需要是指针
+// 读到文本消息时返回错误，这条消息会被丢弃
+func (c *Conn) ReadGob(v interface{}) error {
+	messageType, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if messageType != BinaryMessage {
+		return errNotBinaryMessage
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
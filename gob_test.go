@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGobRoundTrip(t *testing.T) {
+	type event struct {
+		Name   string
+		Labels map[string]string
+		Values []int
+	}
+	want := event{
+		Name:   "deploy",
+		Labels: map[string]string{"env": "prod", "region": "eu"},
+		Values: []int{3, 1, 4, 1, 5},
+	}
+
+	server, client := newTestConnPair()
+	defer server.Close()
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- server.WriteGob(want) }()
+
+	var got event
+	if err := client.ReadGob(&got); err != nil {
+		t.Fatalf("ReadGob() error = %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("WriteGob() error = %v", err)
+	}
+	if client.MessageType() != BinaryMessage {
+		t.Fatalf("message type = %d, want BinaryMessage", client.MessageType())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadGob() = %+v, want %+v", got, want)
+	}
+}
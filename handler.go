@@ -0,0 +1,26 @@
+package main
+
+import "net/http"
+
+// 处理单个 websocket 连接的函数，可以直接作为 http.Handler 挂载，比如 http.Handle("/echo", Handler(echo))
+// 每个请求都会先使用默认配置完成协议升级再调用这个函数，升级失败时已经给客户端返回了 HTTP 错误，不会调用函数
+// 函数返回之后连接会被关闭，函数中发生的 panic 会被恢复并记录日志，然后以 1011 关闭连接，不会影响其他连接
+type Handler func(c *Conn)
+
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := upgrade(w, r)
+	if err != nil {
+		defaultUpgrader.logger().Println("Upgrade error:", err)
+		return
+	}
+	defer c.Close()
+
+	defer func() {
+		if err := recover(); err != nil {
+			c.logger.Printf("Panic in websocket handler of conn %d: %v", c.id, err)
+			c.SendClose(CloseInternalServerErr, "")
+		}
+	}()
+
+	h(c)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandlerClosesConnOnReturn(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	srv := httptest.NewServer(Handler(func(c *Conn) { conns <- c }))
+	defer srv.Close()
+
+	client, err := Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	c := <-conns
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("conn not closed after handler returned")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() error = nil, want the connection to be closed")
+	}
+}
+
+func TestHandlerRecoversPanic(t *testing.T) {
+	srv := httptest.NewServer(Handler(func(c *Conn) {
+		if _, err := c.ReadData(); err != nil {
+			return
+		}
+		panic("boom")
+	}))
+	defer srv.Close()
+
+	// panic 之后以 1011 关闭连接，服务仍然可以处理新的连接
+	for i := 0; i < 2; i++ {
+		client, err := Dial(wsURL(srv), nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		if err := client.SendData([]byte("hi")); err != nil {
+			t.Fatalf("SendData() error = %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = client.ReadMessage()
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != CloseInternalServerErr {
+			t.Fatalf("ReadMessage() error = %v, want close %d", err, CloseInternalServerErr)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 每个连接最多排队等待发送的广播消息数
+const hubQueueSize = 64
+
+// 把同一条文本消息发送给多个连接，比如聊天室
+// 登记、移除和广播都交给同一个 goroutine 处理，每个连接另外有自己的发送 goroutine 和有界队列，
+// 所以一个很慢的连接不会阻塞其他连接，它的队列满了时发给它的消息会被丢弃
+type Hub struct {
+	register   chan *Conn
+	unregister chan *Conn
+	broadcast  chan hubBroadcast
+	count      chan chan int
+	drain      chan chan map[*Conn]chan struct{}
+
+	// 只在 run 中访问
+	clients  map[*Conn]*hubClient
+	draining bool
+}
+
+// 一个登记的连接
+type hubClient struct {
+	send chan hubMessage
+	done chan struct{} // 发送 goroutine 退出时关闭
+}
+
+// 排队等待发送给一个连接的广播消息
+type hubMessage struct {
+	data     []byte
+	deadline time.Time  // 发送这条消息的写超时，零值表示不设置
+	sent     chan *Conn // 不为 nil 时，发送成功之后把连接放进这个 channel
+}
+
+// 交给 run 处理的一次广播，reply 不为 nil 时把消息放进了队列的连接和队列已满的连接发送回去
+type hubBroadcast struct {
+	msg   hubMessage
+	reply chan hubEnqueued
+}
+
+type hubEnqueued struct {
+	queued  []*Conn
+	dropped []*Conn
+	sent    chan *Conn // 即 hubMessage.sent
+}
+
+func NewHub() *Hub {
+	h := &Hub{
+		register:   make(chan *Conn),
+		unregister: make(chan *Conn),
+		broadcast:  make(chan hubBroadcast),
+		count:      make(chan chan int),
+		drain:      make(chan chan map[*Conn]chan struct{}),
+		clients:    make(map[*Conn]*hubClient),
+	}
+	go h.run()
+	return h
+}
+
+// 登记一个连接，之后的广播消息都会发送给它，调用 Drain 之后登记的连接会直接以 1001 关闭
+func (h *Hub) Register(c *Conn) {
+	h.register <- c
+}
+
+// 移除一个连接，连接关闭或者发送失败时会被自动移除
+func (h *Hub) Unregister(c *Conn) {
+	h.unregister <- c
+}
+
+// 把 data 作为文本消息发送给所有登记的连接
+// data 会被所有连接共享，广播之后调用方不能再修改它
+func (h *Hub) Broadcast(data []byte) {
+	h.broadcast <- hubBroadcast{msg: hubMessage{data: data}}
+}
+
+// 和 Broadcast 相同，但是每个连接发送这条消息时都以 timeout 之后作为写超时，并等到所有连接发送完或者超时才返回，
+// 返回跟不上广播的慢速连接：队列已满、消息被丢弃的连接，以及在超时之前没有发送完这条消息的连接
+// 写入超时的连接可能停在某个帧的中间，已经被关闭并从 hub 中移除，队列已满的连接仍然保留，由调用方决定是否断开
+func (h *Hub) BroadcastTimeout(data []byte, timeout time.Duration) (slow []*Conn) {
+	deadline := time.Now().Add(timeout)
+	reply := make(chan hubEnqueued, 1)
+	h.broadcast <- hubBroadcast{msg: hubMessage{data: data, deadline: deadline}, reply: reply}
+	enqueued := <-reply
+	slow = enqueued.dropped
+
+	sent := make(map[*Conn]bool)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+wait:
+	for len(sent) < len(enqueued.queued) {
+		select {
+		case c := <-enqueued.sent:
+			sent[c] = true
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	for _, c := range enqueued.queued {
+		if !sent[c] {
+			slow = append(slow, c)
+		}
+	}
+	return slow
+}
+
+// 返回当前登记的连接数
+func (h *Hub) Len() int {
+	reply := make(chan int)
+	h.count <- reply
+	return <-reply
+}
+
+// 停止接受新的连接，等待已经排队的广播消息都发送出去之后以 1001 关闭所有连接，比如服务退出时
+// 最多等待 timeout，到时还没有发送完的连接可能停在某个帧的中间，不再发送 close 帧直接关闭
+// Drain 之后广播的消息不会再发送给任何连接
+func (h *Hub) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	reply := make(chan map[*Conn]chan struct{})
+	h.drain <- reply
+	clients := <-reply
+
+	// 超时时关闭 expired，通知所有还在等待的 goroutine
+	expired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(expired) })
+	defer timer.Stop()
+	payload := closePayload(CloseGoingAway, "server shutting down")
+
+	var wg sync.WaitGroup
+	for c, done := range clients {
+		wg.Add(1)
+		go func(c *Conn, done chan struct{}) {
+			defer wg.Done()
+			select {
+			case <-done:
+				c.WriteControl(CloseMessage, payload, deadline)
+			case <-expired:
+			}
+			c.Close()
+		}(c, done)
+	}
+	wg.Wait()
+}
+
+func (h *Hub) run() {
+	for {
+		select {
+		case c := <-h.register:
+			if h.draining {
+				go c.SendClose(CloseGoingAway, "server shutting down")
+				continue
+			}
+			if _, ok := h.clients[c]; ok {
+				continue
+			}
+			client := &hubClient{send: make(chan hubMessage, hubQueueSize), done: make(chan struct{})}
+			h.clients[c] = client
+			go h.writeLoop(c, client)
+		case c := <-h.unregister:
+			if client, ok := h.clients[c]; ok {
+				delete(h.clients, c)
+				close(client.send)
+			}
+		case b := <-h.broadcast:
+			var enqueued hubEnqueued
+			if b.reply != nil {
+				// 每个连接最多发送一次，缓冲区足够时发送 goroutine 不会阻塞
+				b.msg.sent = make(chan *Conn, len(h.clients))
+			}
+			for c, client := range h.clients {
+				select {
+				case client.send <- b.msg:
+					c.queueDepth.Add(1)
+					enqueued.queued = append(enqueued.queued, c)
+				default:
+					c.logger.Printf("Hub queue of conn %d is full, drop broadcast message", c.id)
+					enqueued.dropped = append(enqueued.dropped, c)
+				}
+			}
+			if b.reply != nil {
+				enqueued.sent = b.msg.sent
+				b.reply <- enqueued
+			}
+		case reply := <-h.count:
+			reply <- len(h.clients)
+		case reply := <-h.drain:
+			// 关闭所有的队列，发送 goroutine 把队列中剩下的消息发送完之后就会退出
+			h.draining = true
+			done := make(map[*Conn]chan struct{}, len(h.clients))
+			for c, client := range h.clients {
+				close(client.send)
+				done[c] = client.done
+			}
+			h.clients = make(map[*Conn]*hubClient)
+			reply <- done
+		}
+	}
+}
+
+// 把队列中的消息依次发送给一个连接，发送失败或者连接关闭时关闭连接并把它从 hub 中移除
+func (h *Hub) writeLoop(c *Conn, client *hubClient) {
+	defer close(client.done)
+	for {
+		select {
+		case msg, ok := <-client.send:
+			if !ok {
+				return
+			}
+			c.queueDepth.Add(-1)
+			if err := h.send(c, msg); err != nil {
+				c.logger.Printf("Hub failed to send to conn %d: %v", c.id, err)
+				c.Close()
+				h.leave(c, client)
+				return
+			}
+			if msg.sent != nil {
+				msg.sent <- c
+			}
+		case <-c.Context().Done():
+			h.leave(c, client)
+			return
+		}
+	}
+}
+
+// 发送 goroutine 提前退出时把连接从 hub 中移除，队列中剩下的消息不会再发送，也不再计入 QueueDepth
+func (h *Hub) leave(c *Conn, client *hubClient) {
+	h.Unregister(c)
+	for range client.send {
+		c.queueDepth.Add(-1)
+	}
+}
+
+// 连接的统计信息快照，见 Conn.Stats
+type ConnStats struct {
+	QueueDepth int64 // 在 Hub 的队列中等待发送给这个连接的广播消息数
+}
+
+// 返回连接当前的统计信息，可以在任何 goroutine 中调用
+// QueueDepth 持续增长说明连接跟不上广播，队列满了之后的消息会被丢弃
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{QueueDepth: c.queueDepth.Load()}
+}
+
+// 发送一条广播消息，设置了写超时时只对这一条消息生效，发送完之后恢复连接原来的写超时
+func (h *Hub) send(c *Conn, msg hubMessage) error {
+	if msg.deadline.IsZero() {
+		return c.SendData(msg.data)
+	}
+	return c.writeMessageWithDeadline(TextMessage, msg.data, msg.deadline)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 等待 hub 中登记的连接数变成 n
+func waitHubLen(t *testing.T, h *Hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for h.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Hub.Len() = %d, want %d", h.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubBroadcast(t *testing.T) {
+	h := NewHub()
+	var clients []*Conn
+	for i := 0; i < 3; i++ {
+		server, client := newTestConnPair()
+		defer server.Close()
+		defer client.Close()
+		h.Register(server)
+		clients = append(clients, client)
+	}
+	waitHubLen(t, h, 3)
+
+	h.Broadcast([]byte("hello"))
+	for i, client := range clients {
+		typ, data, err := client.ReadMessage()
+		if err != nil || typ != TextMessage || string(data) != "hello" {
+			t.Fatalf("client %d ReadMessage() = %d, %q, %v", i, typ, data, err)
+		}
+	}
+}
+
+func TestHubRemovesDeadConn(t *testing.T) {
+	h := NewHub()
+	alive, aliveClient := newTestConnPair()
+	defer alive.Close()
+	defer aliveClient.Close()
+	dead, deadClient := newTestConnPair()
+	defer dead.Close()
+	h.Register(alive)
+	h.Register(dead)
+	waitHubLen(t, h, 2)
+
+	// 对端断开之后发送失败，连接会被关闭并从 hub 中移除
+	deadClient.Close()
+	h.Broadcast([]byte("ping"))
+	if _, data, err := aliveClient.ReadMessage(); err != nil || string(data) != "ping" {
+		t.Fatalf("ReadMessage() = %q, %v", data, err)
+	}
+	waitHubLen(t, h, 1)
+	select {
+	case <-dead.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("dead conn was not closed")
+	}
+}
+
+func TestHubBroadcastTimeoutReportsSlowConsumer(t *testing.T) {
+	h := NewHub()
+	fast, fastClient := newTestConnPair()
+	defer fast.Close()
+	defer fastClient.Close()
+	// net.Pipe 没有缓冲，对端一直不读取时写入会一直阻塞
+	slow, slowPeer := newTestServerConn()
+	defer slow.Close()
+	defer slowPeer.Close()
+	h.Register(fast)
+	h.Register(slow)
+	waitHubLen(t, h, 2)
+
+	received := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			_, data, _ := fastClient.ReadMessage()
+			received <- string(data)
+		}
+	}()
+
+	laggards := h.BroadcastTimeout([]byte("news"), 50*time.Millisecond)
+	if len(laggards) != 1 || laggards[0] != slow {
+		t.Fatalf("BroadcastTimeout() = %v, want only the slow conn", laggards)
+	}
+	if got := <-received; got != "news" {
+		t.Fatalf("fast consumer received %q", got)
+	}
+
+	// 写入超时的连接被关闭并移除
+	waitHubLen(t, h, 1)
+	if h.BroadcastTimeout([]byte("more"), time.Second) != nil {
+		t.Fatal("BroadcastTimeout() reported the fast conn")
+	}
+	if got := <-received; got != "more" {
+		t.Fatalf("fast consumer received %q", got)
+	}
+}
+
+func TestHubDrain(t *testing.T) {
+	h := NewHub()
+	server, client := newTestConnPair()
+	defer server.Close()
+	defer client.Close()
+	h.Register(server)
+	waitHubLen(t, h, 1)
+
+	type result struct {
+		data string
+		err  error
+	}
+	results := make(chan result, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			_, data, err := client.ReadMessage()
+			results <- result{string(data), err}
+		}
+	}()
+
+	h.Broadcast([]byte("last"))
+	h.Drain(time.Second)
+
+	if r := <-results; r.err != nil || r.data != "last" {
+		t.Fatalf("first ReadMessage() = %q, %v, want the last broadcast", r.data, r.err)
+	}
+	var ce *CloseError
+	if r := <-results; !errors.As(r.err, &ce) || ce.Code != CloseGoingAway {
+		t.Fatalf("second ReadMessage() error = %v, want close 1001", r.err)
+	}
+	if h.Len() != 0 {
+		t.Fatalf("Hub.Len() = %d after Drain", h.Len())
+	}
+
+	// Drain 之后登记的连接直接以 1001 关闭
+	late, lateClient := newTestConnPair()
+	defer late.Close()
+	defer lateClient.Close()
+	h.Register(late)
+	if _, _, err := lateClient.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseGoingAway {
+		t.Fatalf("late ReadMessage() error = %v, want close 1001", err)
+	}
+}
+
+func TestConnStatsQueueDepth(t *testing.T) {
+	h := NewHub()
+	c, peer := newTestServerConn()
+	defer c.Close()
+	h.Register(c)
+	waitHubLen(t, h, 1)
+
+	// 对端暂时不读取，第一条消息阻塞在写入中，剩下的都留在队列里
+	for i := 0; i < 5; i++ {
+		h.Broadcast([]byte("queued"))
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().QueueDepth != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("QueueDepth = %d, want 4", c.Stats().QueueDepth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := readTestFrame(peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth := c.Stats().QueueDepth; depth != 0 {
+		t.Fatalf("QueueDepth = %d after the consumer caught up, want 0", depth)
+	}
+	peer.Close()
+}
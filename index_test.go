@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIndexWebSocketURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		host  string
+		proto string
+		want  string // 经过模板的 JS 转义之后的地址
+	}{
+		{"plain", "example.com:9000", "", `ws:\/\/example.com:9000\/echo`},
+		{"behind https proxy", "example.com", "https", `wss:\/\/example.com\/echo`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		rec := httptest.NewRecorder()
+		index(rec, r)
+		if body := rec.Body.String(); !strings.Contains(body, `new WebSocket("`+tt.want+`")`) {
+			t.Errorf("%s: page does not connect to %s, got:\n%s", tt.name, tt.want, body)
+		}
+	}
+}
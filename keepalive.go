@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// 发送 ping 帧，data 不能超过 125 字节
+func (c *Conn) SendPing(data []byte) error {
+	return c.writeControl(PingMessage, data)
+}
+
+// 启动一个 goroutine 每隔 interval 检查一次连接，这段时间内没有收发过数据帧时才发送 ping，ping 的数据是递增的序号，
+// 连接一直有数据往来时不会发送任何 ping。如果到下一次检查时还没有收到携带相同序号的 pong，就以 1011 关闭连接
+// pong 是在读取连接时处理的，所以需要有 goroutine 在持续读取这个连接
+// interval 必须大于 0，否则返回错误，不会启动 goroutine
+func (c *Conn) EnableKeepalive(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("websocket: non-positive keepalive interval")
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var seq uint64   // 最近一次发送的 ping 的序号
+		var waiting bool // 是否在等待这个 ping 的 pong
+		var ping [8]byte
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if waiting && c.pongSeq.Load() != seq {
+				c.logger.Printf("Keepalive pong not received within %s, connection will be closed", interval)
+				c.WriteControl(CloseMessage, closePayload(CloseInternalServerErr, "keepalive timeout"), time.Now().Add(interval))
+				c.Close()
+				return
+			}
+			waiting = false
+
+			if time.Since(c.lastDataTime()) < interval {
+				continue
+			}
+			seq++
+			binary.BigEndian.PutUint64(ping[:], seq)
+			if err := c.WriteControl(PingMessage, ping[:], time.Now().Add(interval)); err != nil {
+				return
+			}
+			waiting = true
+		}
+	}()
+	return nil
+}
+
+// 记录收发了一个数据帧，keepalive 只在一段时间内没有数据帧时才发送 ping
+func (c *Conn) markDataActivity() {
+	c.lastDataAt.Store(time.Now().UnixNano())
+}
+
+// 返回最近一次收发数据帧的时间，还没有收发过时是协议升级完成的时间
+func (c *Conn) lastDataTime() time.Time {
+	return time.Unix(0, c.lastDataAt.Load())
+}
+
+// 记录收到的 pong 中携带的 keepalive 序号
+func (c *Conn) handleKeepalivePong(data []byte) {
+	if len(data) == 8 {
+		c.pongSeq.Store(binary.BigEndian.Uint64(data))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnableKeepaliveRejectsNonPositiveInterval(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := c.EnableKeepalive(interval); err == nil {
+			t.Errorf("EnableKeepalive(%s) succeeded", interval)
+		}
+	}
+}
+
+// 对端只读取不回复 pong，到下一次发送 ping 时以 1011 关闭连接
+func TestKeepaliveClosesWithoutPong(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, nil)
+
+	if err := c.EnableKeepalive(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed although the peer never sent a pong")
+	}
+
+	frames := finish()
+	if len(frames) == 0 || frames[0].opcode() != PingMessage {
+		t.Fatalf("frames = %+v, want a ping first", frames)
+	}
+	if code := closeCodeOf(frames); code != CloseInternalServerErr {
+		t.Fatalf("close code = %d, want %d", code, CloseInternalServerErr)
+	}
+}
+
+// 在 d 时间内统计客户端收到的 ping，active 为 true 时客户端持续发送数据
+func countKeepalivePings(t *testing.T, active bool, d time.Duration) int {
+	server, client := newTestConnPair()
+	defer server.Close()
+	defer client.Close()
+	frames := client.DebugFrames()
+
+	go func() {
+		for {
+			if _, _, err := server.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err := server.EnableKeepalive(40 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if active {
+			if err := client.SendData([]byte("busy")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if server.Context().Err() != nil {
+		t.Fatal("keepalive closed the connection")
+	}
+
+	pings := 0
+	for {
+		select {
+		case f := <-frames:
+			if f.Opcode == PingMessage {
+				pings++
+			}
+		default:
+			return pings
+		}
+	}
+}
+
+func TestKeepalivePingsOnlyWhenIdle(t *testing.T) {
+	if n := countKeepalivePings(t, true, 300*time.Millisecond); n != 0 {
+		t.Fatalf("active connection received %d pings, want 0", n)
+	}
+	if n := countKeepalivePings(t, false, 300*time.Millisecond); n == 0 {
+		t.Fatal("idle connection received no pings")
+	}
+}
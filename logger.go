@@ -0,0 +1,30 @@
+package main
+
+// 内部日志的输出接口，标准库的 *log.Logger 就满足这个接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// 默认的日志，什么都不输出
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+func (nopLogger) Println(v ...interface{})               {}
+
+// 设置连接的日志，通过 Dial 得到的连接可以用它打开日志，l 为 nil 时不输出日志
+// 需要在开始读写连接之前设置
+func (c *Conn) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	c.logger = l
+}
+
+// 返回握手过程和升级后的连接使用的日志
+func (u *Upgrader) logger() Logger {
+	if u.Logger != nil {
+		return u.Logger
+	}
+	return nopLogger{}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 把所有日志记录在内存中的 Logger，用于检查输出了哪些日志
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *captureLogger) Println(v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// 返回包含 substr 的日志
+func (l *captureLogger) find(substr string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []string
+	for _, line := range l.lines {
+		if strings.Contains(line, substr) {
+			found = append(found, line)
+		}
+	}
+	return found
+}
+
+func TestUpgraderLogger(t *testing.T) {
+	logger := &captureLogger{}
+	addr, conns := newUpgradeTestServer(t, &Upgrader{Logger: logger})
+	_, client, _ := rawHandshake(t, addr, "")
+	c := <-conns
+	defer c.Close()
+
+	// 客户端发送不带 mask 的帧，服务端应该拒绝并记录日志
+	if _, err := client.Write(buildTestFrame(0x81, false, []byte("hi"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadData(); err == nil {
+		t.Fatal("expected error for unmasked frame")
+	}
+
+	for _, want := range []string{
+		"Upgrade http to websocket successfully",
+		"Recived unmasked frame from client",
+	} {
+		if len(logger.find(want)) == 0 {
+			t.Errorf("missing log %q, got %q", want, logger.lines)
+		}
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	logger := &captureLogger{}
+	c.SetLogger(logger)
+
+	go peer.Write(clientFrame(0x88, closePayload(CloseNormalClosure, "bye")))
+	go io.Copy(io.Discard, peer)
+	c.ReadData()
+
+	if len(logger.find("Recived closed message, code: 1000, reason: bye")) == 0 {
+		t.Errorf("missing close log, got %q", logger.lines)
+	}
+}
@@ -1,15 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"html/template"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 /* Websocket 协议包
@@ -42,120 +60,1223 @@ func computeAcceptKey(challengeKey string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+// 帧头第一个字节中的各个位
 const (
-	finalBit     = 1 << 7
-	maskBit      = 1 << 7
-	TextMessage  = 1
-	CloseMessage = 8
+	finalBit   = 1 << 7
+	rsv1Bit    = 1 << 6
+	rsv2Bit    = 1 << 5
+	rsv3Bit    = 1 << 4
+	opCodeMask = 0x0f
 )
 
+// 帧头第二个字节中的各个位，和 finalBit 的值相同，但是在不同的字节里
+const (
+	maskBit        = 1 << 7
+	payloadLenMask = 0x7f
+)
+
+// opcode，参见 RFC 6455 5.2
+const (
+	ContinuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// 一个 websocket 连接
+// 所有写方法（SendData、SendBinary、WriteTextString、WriteBatch、NextWriter 以及 ping、pong、close 等控制帧）
+// 都可以在多个 goroutine 中并发调用，每个帧都在 writeMu 的保护下完整地写入，不会交错，
+// 一条数据消息的所有分片写完之前，其他 goroutine 发送的数据消息会等待，但是 NextWriter 返回的 writer Close 之前
+// 在同一个 goroutine 中发送其他数据消息会死锁，再次调用 NextWriter 则返回 ErrWriterNotClosed
+// 读方法（ReadData、NextReader 等）不支持并发调用，同一时间只能有一个 goroutine 读取连接
 type Conn struct {
 	writeBuf []byte
 	maskKey  [4]byte
 	conn     net.Conn
+	br       *bufio.Reader // 所有的读取都经过这个缓冲读取器
+	caps     Capabilities  // 通过 NegotiateCapabilities 协商出的能力
+	readBuf  []byte        // 可复用的读缓冲区，见 Upgrader.InitialReadBuffer
+
+	messageType int    // 最近一次 ReadData 读到的消息类型
+	closeErr    error  // 收到对端的 close 帧之后，后续的读取都返回这个 *CloseError
+	subprotocol string // 握手时协商出的子协议
+	compression bool   // 握手时是否协商了 permessage-deflate 或 x-deflate-dictionary
+
+	compressionInfo CompressionInfo        // 握手时协商出的压缩参数，见 CompressionInfo
+	dictionary      *CompressionDictionary // 协商出的共享压缩字典，没有使用字典时为 nil
+	extensions      []Extension            // 握手时协商出的扩展，见 NegotiatedExtensions
+
+	deadlineFunc DeadlineFunc
+	logger       Logger // 内部日志，见 SetLogger 和 Upgrader.Logger
+
+	pingHandler func(appData []byte) error // 见 SetPingHandler
+	pongHandler func(appData []byte) error // 见 SetPongHandler
+
+	poorCompression func(in, out int) // 见 SetPoorCompressionHandler
+
+	// SetWriteDeadline 设置的写超时，WriteControl 写完之后用它恢复底层连接的超时
+	// 不使用 writeMu 保护，这样写入阻塞时其他 goroutine 仍然可以通过 SetWriteDeadline 让它超时返回
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time
+
+	writeMu   sync.Mutex // 保证每个帧完整地写入，不会和其他 goroutine 写入的帧交错
+	closeSent bool       // 是否已经发送过 close 帧，发送之后只能再写入 ping 和 pong
+
+	// 保证一条数据消息的所有分片连续写出，不会和其他数据消息交错，需要在 writeMu 之前获取
+	// 控制帧不需要它，可以插在分片之间发送
+	messageMu  sync.Mutex
+	writerOpen atomic.Bool    // NextWriter 返回的 writer 是否还没有 Close，见 ErrWriterNotClosed
+	reader     *messageReader // 最近一次 NextReader 返回的 reader
+
+	id         uint64        // 连接编号，用于日志
+	isServer   bool          // 是否是服务端的连接，决定了发送时是否需要掩码以及收到的帧是否必须带掩码
+	noMask     bool          // 握手时是否协商了 x-no-mask，客户端发送的帧不再带掩码，服务端也接受不带掩码的帧
+	upgradedAt time.Time     // 协议升级完成的时间
+	pongSeq    atomic.Uint64 // 最近收到的 keepalive pong 的序号，见 EnableKeepalive
+	queueDepth atomic.Int64  // 在 Hub 的队列中等待发送的消息数，见 Stats
+	lastDataAt atomic.Int64  // 最近一次收发数据帧的时间（UnixNano），见 EnableKeepalive
+
+	ctx    context.Context // 连接关闭时会被取消，见 Context
+	cancel context.CancelFunc
+
+	maxTextMessageSize   int64 // 文本消息的最大长度，为 0 时使用 maxMessageSize
+	maxBinaryMessageSize int64 // 二进制消息的最大长度，为 0 时使用 maxMessageSize
+	maxMessageSize       int64 // 没有单独设置长度限制的消息的最大长度，小于等于 0 时不限制
+	budget               *MemoryBudget
+	fragmentBudget       *FragmentBudget
+	strictCloseCodes     bool // 是否把未定义或保留的 close 状态码视为协议错误
+	discardAfterClose    bool // 发送 close 帧之后是否丢弃收到的数据帧
+	readWatchdog         time.Duration
+	maxControlPayload    int64 // 控制帧 payload 的最大长度，不会超过 125
+
+	pendingMu sync.Mutex
+	pending   map[string]chan Message // 等待响应的 Request，以消息 id 为键
+
+	debugMu     sync.Mutex
+	debugFrames chan FrameInfo // 见 DebugFrames
+
+	stateMu sync.Mutex
+	state   map[string]interface{} // 应用附加在连接上的状态
 }
 
-func maskBytes(key [4]byte, b []byte) {
-	pos := 0
+// 动态计算下一次读写的超时时间，write 为 true 时表示写操作，返回零值表示不设置超时
+type DeadlineFunc func(write bool) time.Time
+
+// 设置动态计算超时时间的回调，每次读取消息和写入帧之前都会调用它来设置超时
+func (c *Conn) SetDeadlineFunc(f DeadlineFunc) {
+	c.deadlineFunc = f
+}
+
+// 设置收到 ping 时调用的处理函数，处理函数在读取连接的 goroutine 中调用，返回错误时读取会中断并返回这个错误
+// 默认的处理函数会用相同的数据回复 pong，设置了自己的处理函数之后不会再自动回复，需要时可以在处理函数中调用 WriteControl
+// h 为 nil 时恢复默认的处理函数
+func (c *Conn) SetPingHandler(h func(appData []byte) error) {
+	c.pingHandler = h
+}
+
+// 设置收到 pong 时调用的处理函数，调用方式和 SetPingHandler 相同，默认什么都不做
+// h 为 nil 时恢复默认的处理函数
+func (c *Conn) SetPongHandler(h func(appData []byte) error) {
+	c.pongHandler = h
+}
+
+// 设置底层连接的读超时，t 为零值时表示不超时
+// 超时时间对整条消息生效，读取帧头和 payload 的每次 io 操作都使用同一个超时时间，不会在中间被重置
+// 读取超时之后连接可能停在某个帧的中间，已经不能再继续使用，应该直接关闭
+// 注意设置了 DeadlineFunc 时，每次读取消息之前都会用它的返回值覆盖这里设置的超时
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// 设置底层连接的写超时，t 为零值时表示不超时
+// 写入超时之后帧可能只写出了一部分，连接已经不能再继续使用，应该直接关闭
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) getWriteDeadline() time.Time {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	return c.writeDeadline
+}
+
+// 在连接上保存应用自己的状态，比如用户 id、会话等，可以在多个 goroutine 中并发调用
+func (c *Conn) SetState(key string, value interface{}) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state == nil {
+		c.state = make(map[string]interface{})
+	}
+	c.state[key] = value
+}
+
+// 读取通过 SetState 保存的状态
+func (c *Conn) GetState(key string) (value interface{}, ok bool) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	value, ok = c.state[key]
+	return value, ok
+}
+
+// 返回连接的角色，通过 Upgrade 得到的连接为 true，通过 Dial 得到的连接为 false
+func (c *Conn) IsServer() bool {
+	return c.isServer
+}
+
+// 返回协议升级完成的时间
+func (c *Conn) UpgradedAt() time.Time {
+	return c.upgradedAt
+}
+
+// 返回连接从协议升级完成到现在的时长
+func (c *Conn) Age() time.Duration {
+	return time.Since(c.upgradedAt)
+}
+
+// 返回握手时协商出的子协议，没有协商出子协议时为空字符串
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// 返回对端的网络地址
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// 返回本端的网络地址
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// 返回连接的 context，调用 Close 或者读取时发现对端断开、网络出错时它都会被取消，
+// 和连接绑定的 goroutine 可以通过它得知连接已经关闭并退出。对端断开只有在读取时才能发现，所以需要有 goroutine 在持续读取
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// 关闭底层连接并取消连接的 context
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.conn.Close()
+}
+
+// 读取底层连接出错时（对端断开、网络错误、读超时）连接已经不能再使用，取消连接的 context
+// 协议错误和收到 close 帧时已经调用过 Close，ping、pong 处理函数返回的错误则不代表连接断开
+func (c *Conn) readFailed(err error) {
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe) || errors.As(err, &netErr) {
+		c.cancel()
+	}
+}
+
+// 用 mask key 对数据做掩码或者解除掩码，pos 是 b 在整个 payload 中的起始位置，返回处理完之后的位置
+func maskBytes(key [4]byte, pos int, b []byte) int {
 	for i := range b {
 		b[i] ^= key[pos&3]
 		pos++
 	}
+	return pos
+}
+
+// 发送一条消息，写入底层连接失败或者没有完整写入时返回错误
+// TextMessage 和 BinaryMessage 是数据消息，协商过最大帧长度时，超过长度的消息会被拆分成多个分片发送
+// CloseMessage、PingMessage 和 PongMessage 是控制帧，data 不能超过 125 字节，发送 close 帧之后不会关闭连接，需要时使用 SendClose
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage:
+		c.messageMu.Lock()
+		defer c.messageMu.Unlock()
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		return c.sendData(messageType, data)
+	case CloseMessage, PingMessage, PongMessage:
+		return c.writeControl(messageType, data)
+	default:
+		return errors.New("websocket: bad message type for WriteMessage")
+	}
+}
+
+// 发送文本数据，等同于 WriteMessage(TextMessage, data)
+func (c *Conn) SendData(data []byte) error {
+	return c.WriteMessage(TextMessage, data)
+}
+
+// 发送二进制数据，等同于 WriteMessage(BinaryMessage, data)
+func (c *Conn) SendBinary(data []byte) error {
+	return c.WriteMessage(BinaryMessage, data)
+}
+
+// 以 deadline 作为写超时发送一条数据消息，写完之后恢复 SetWriteDeadline 设置的超时
+// 超时在 writeMu 的保护下设置和恢复，和 WriteControl 一样，不会被其他 goroutine 写入控制帧时覆盖
+func (c *Conn) writeMessageWithDeadline(messageType int, data []byte, deadline time.Time) error {
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(deadline)
+	defer c.conn.SetWriteDeadline(c.getWriteDeadline())
+	return c.sendData(messageType, data)
+}
+
+// 调用方需要持有 writeMu
+// 启用了 permessage-deflate 时先压缩整条消息，再按照最大帧长度分片，只有第一个分片设置 RSV1 位
+func (c *Conn) sendData(messageType int, data []byte) error {
+	compressed := c.compression
+	if compressed {
+		in := len(data)
+		data = compressData(data, c.dictionary)
+		c.checkCompressionRatio(in, len(data))
+	}
+
+	frameType := messageType
+	for max := c.caps.MaxFrameSize; max > 0 && len(data) > max; data = data[max:] {
+		if err := c.writeFrameLocked(frameType, false, compressed, data[:max]); err != nil {
+			return err
+		}
+		frameType = ContinuationFrame
+		compressed = false
+	}
+	return c.writeFrameLocked(frameType, true, compressed, data)
+}
+
+// 批量写入时使用的写入器
+type BatchWriter interface {
+	SendData(data []byte) error
+	SendBinary(data []byte) error
+}
+
+type batchWriter struct {
+	c *Conn
+}
+
+func (w batchWriter) SendData(data []byte) error {
+	return w.c.sendData(TextMessage, data)
+}
+
+func (w batchWriter) SendBinary(data []byte) error {
+	return w.c.sendData(BinaryMessage, data)
+}
+
+// 在整个回调期间持有写锁，回调中写入的帧不会被其他 goroutine 写入的任何帧（包括控制帧）打断，
+// 其他写操作会等到回调结束之后再进行。回调中只能通过 w 写入，调用 Conn 上的写方法会导致死锁
+func (c *Conn) WriteBatch(fn func(w BatchWriter) error) error {
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return fn(batchWriter{c})
+}
+
+// 每个连接最多保留的写缓冲区大小
+const maxRetainedWriteBuf = 64 << 10
+
+var errControlFrameTooLong = errors.New("websocket: control frame payload too long")
+
+// 写入一个控制帧，控制帧的 payload 不能超过 125 字节
+func (c *Conn) writeControl(messageType int, data []byte) error {
+	if len(data) > maxControlFramePayload {
+		return errControlFrameTooLong
+	}
+	return c.writeFrame(messageType, true, data)
 }
 
-// 发送数据
-func (c *Conn) SendData(data []byte) {
+// 以 deadline 作为超时时间写入一个控制帧，messageType 只能是 CloseMessage、PingMessage 或 PongMessage，
+// data 不能超过 125 字节，deadline 为零值时表示不超时
+// 控制帧不需要等待正在写入的数据消息，NextWriter 写入很大的消息期间也会在两个分片之间及时发送
+// 这里的超时只对这一个帧生效，写完之后会恢复 SetWriteDeadline 设置的超时
+func (c *Conn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != CloseMessage && messageType != PingMessage && messageType != PongMessage {
+		return errors.New("websocket: bad message type for WriteControl")
+	}
+	if len(data) > maxControlFramePayload {
+		return errControlFrameTooLong
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	frame, err := c.buildFrameLocked(messageType, true, false, data)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(deadline)
+	err = c.writeAll(frame)
+	c.conn.SetWriteDeadline(c.getWriteDeadline())
+	return err
+}
+
+// 返回是否已经发送过 close 帧
+func (c *Conn) isCloseSent() bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.closeSent
+}
+
+// 组装并写入一个帧
+func (c *Conn) writeFrame(frameType int, final bool, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(frameType, final, false, data)
+}
+
+// 调用方需要持有 writeMu
+// compressed 为 true 时设置 RSV1 位，表示这是一条压缩消息的第一个帧
+func (c *Conn) writeFrameLocked(frameType int, final bool, compressed bool, data []byte) error {
+	frame, err := c.buildFrameLocked(frameType, final, compressed, data)
+	if err != nil {
+		return err
+	}
+	if c.deadlineFunc != nil {
+		c.conn.SetWriteDeadline(c.deadlineFunc(true))
+	}
+	if frameType < CloseMessage {
+		c.markDataActivity()
+	}
+	return c.writeAll(frame)
+}
+
+// 组装一个帧，返回的数据在下一次组装之前有效，调用方需要持有 writeMu
+func (c *Conn) buildFrameLocked(frameType int, final bool, compressed bool, data []byte) ([]byte, error) {
+	// 发送 close 帧之后不能再发送数据帧和第二个 close 帧，但在收到对端回应的 close 帧之前仍然要回复 ping
+	if c.closeSent && frameType != PingMessage && frameType != PongMessage {
+		return nil, ErrCloseSent
+	}
+	if frameType == CloseMessage {
+		c.closeSent = true
+	}
+
+	// 复用上一次的缓冲区，容量不够时才重新分配，帧头的每个字节都会被重新写入，所以不需要清零
 	length := len(data)
-	c.writeBuf = make([]byte, 10+length)
+	buf := c.writeBuf
+	if cap(buf) >= 14+length {
+		buf = buf[:14+length]
+	} else {
+		buf = make([]byte, 14+length)
+		// 偶尔发送一条很大的消息时不保留它的缓冲区，避免连接一直占着这块内存
+		if len(buf) <= maxRetainedWriteBuf {
+			c.writeBuf = buf
+		}
+	}
+	playloadStart := putFrameHeader(buf, frameType, final, length)
+	if compressed {
+		buf[0] |= rsv1Bit
+	}
+
+	// 客户端发送的帧必须带掩码，每个帧都使用新随机生成的 mask key，只有协商了 x-no-mask 时才不带
+	if !c.isServer && !c.noMask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil, err
+		}
+		buf[1] |= maskBit
+		playloadStart += copy(buf[playloadStart:], key[:])
+		copy(buf[playloadStart:], data[:])
+		maskBytes(key, 0, buf[playloadStart:playloadStart+length])
+	} else {
+		copy(buf[playloadStart:], data[:])
+	}
+	return buf[:playloadStart+length], nil
+}
+
+// 把帧头写入 buf 并返回帧头的长度，buf 至少需要 10 个字节
+func putFrameHeader(buf []byte, frameType int, final bool, length int) int {
 	playloadStart := 2
-	c.writeBuf[0] = byte(TextMessage) | finalBit
+	buf[0] = byte(frameType)
+	if final {
+		buf[0] |= finalBit
+	}
 
 	switch {
-	case length >= 65535:
-		c.writeBuf[1] = byte(0x00) | 127
-		binary.BigEndian.PutUint64(c.writeBuf[playloadStart:], uint64(length))
+	case length > 65535:
+		buf[1] = byte(0x00) | 127
+		binary.BigEndian.PutUint64(buf[playloadStart:], uint64(length))
 		playloadStart += 8
 	case length > 125:
-		c.writeBuf[1] = byte(0x00) | 126
-		binary.BigEndian.PutUint16(c.writeBuf[playloadStart:], uint16(length))
+		buf[1] = byte(0x00) | 126
+		binary.BigEndian.PutUint16(buf[playloadStart:], uint16(length))
 		playloadStart += 2
 	default:
-		c.writeBuf[1] = byte(0x00) | byte(length)
+		buf[1] = byte(0x00) | byte(length)
+	}
+
+	// 服务端发送的帧不能带掩码，不管是哪种长度格式都显式清掉 MASK 位，
+	// 客户端需要掩码时由调用方重新设置
+	buf[1] &^= maskBit
+	return playloadStart
+}
+
+// 底层连接只写入了一部分时继续写剩下的部分，返回 io.ErrShortWrite 也视为可以继续，
+// 其他错误或者完全没有写入任何字节时直接返回
+func (c *Conn) writeAll(buf []byte) error {
+	for len(buf) > 0 {
+		n, err := c.conn.Write(buf)
+		buf = buf[n:]
+		if err != nil && err != io.ErrShortWrite {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
 	}
-	copy(c.writeBuf[playloadStart:], data[:])
-	c.conn.Write(c.writeBuf[:playloadStart+length])
+	return nil
 }
 
-// 读取数据
+// 发送字符串形式的文本数据
+// 服务端发送的帧不需要掩码，payload 不会被修改，按照 io.Writer 的约定 Write 也不会修改传入的数据，
+// 所以可以直接把字符串的内存交给底层连接写出，省去 []byte(s) 的内存分配和复制
+// 客户端连接需要对 payload 做掩码，协商了最大帧长度时可能需要分片，启用了压缩时需要先压缩，这几种情况会退回到普通的发送流程
+func (c *Conn) WriteTextString(s string) error {
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if (!c.isServer && !c.noMask) || c.compression || (c.caps.MaxFrameSize > 0 && len(s) > c.caps.MaxFrameSize) {
+		return c.sendData(TextMessage, []byte(s))
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	var header [10]byte
+	n := putFrameHeader(header[:], TextMessage, true, len(s))
+	if c.deadlineFunc != nil {
+		c.conn.SetWriteDeadline(c.deadlineFunc(true))
+	}
+	c.markDataActivity()
+	if err := c.writeAll(header[:n]); err != nil {
+		return err
+	}
+	return c.writeAll(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// 以 json 格式发送数据，编码结果和 NextWriter 一样直接写入帧，超过帧长度时会自动分片
+func (c *Conn) WriteJSON(v interface{}) error {
+	w, err := c.newMessageWriter(TextMessage, false)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// 编码失败时 Encoder 不会写入任何数据，直接放弃这条消息
+		w.abort()
+		return err
+	}
+	return w.Close()
+}
+
+// 读取一条完整的消息，返回消息类型（TextMessage 或 BinaryMessage）和 payload，
+// 控制帧在读取过程中内部处理，不会返回给调用方
+func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
+	c.messageType, p, err = c.readData(false)
+	return c.messageType, p, err
+}
+
+// 读取数据，和 ReadMessage 相同，只是不返回消息类型
+// 读到的消息类型可以通过 MessageType 获得
 func (c *Conn) ReadData() (data []byte, err error) {
-	var b [8]byte
+	c.messageType, data, err = c.readData(false)
+	return data, err
+}
+
+// 读取数据，与 ReadData 不同的是读取 payload 中途出错时会把已经读到的部分数据和错误一起返回，
+// 便于排查问题时查看实际到达了哪些内容
+func (c *Conn) ReadDataPartial() (data []byte, err error) {
+	c.messageType, data, err = c.readData(true)
+	return data, err
+}
 
-	if _, err := c.conn.Read(b[:2]); err != nil {
+// 读取数据，ctx 结束时通过把读超时设置到过去让阻塞的读取立即返回，并返回 ctx.Err()
+// 读取被中断时连接可能停在某个帧的中间，所以 ctx 结束之后连接都会被关闭
+// 只在 ctx 结束时才启动 goroutine 设置超时，读取返回之后不会留下任何 goroutine
+func (c *Conn) ReadDataContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		c.Close()
 		return nil, err
 	}
 
-	// 提取FIN位
-	final := b[0]&finalBit != 0
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	data, err := c.ReadData()
+	if !stop() {
+		c.Close()
+		if err != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return data, err
+}
 
-	if !final {
-		log.Println("Recived fragmented frame, not support")
-		return nil, errors.New("not support fragmented message")
+// 返回最近一次 ReadData 读到的消息类型，TextMessage 或 BinaryMessage，读取失败时为 0
+func (c *Conn) MessageType() int {
+	return c.messageType
+}
+
+// 读取一条消息，并把开头的 prefixLen 个字节作为路由前缀和剩余的 payload 分开返回，同时返回消息类型
+// prefixLen 小于 0 时不读取消息直接返回错误，消息长度不足 prefixLen 时返回错误
+func (c *Conn) ReadRouted(prefixLen int) (prefix []byte, payload []byte, messageType int, err error) {
+	if prefixLen < 0 {
+		return nil, nil, 0, errors.New("websocket: negative routing prefix length")
+	}
+	messageType, data, err := c.readData(false)
+	if err != nil {
+		return nil, nil, 0, err
 	}
+	if len(data) < prefixLen {
+		return nil, nil, messageType, errors.New("websocket: message shorter than routing prefix")
+	}
+	return data[:prefixLen], data[prefixLen:], messageType, nil
+}
 
-	frameType := int(b[0] & 0xf)
+// 一条完整的消息
+type Message struct {
+	Type int
+	Data []byte
+}
 
-	if frameType == CloseMessage {
-		c.conn.Close()
-		log.Println("Recived closed message, connection will be closed")
-		return nil, errors.New("recived closed message")
+// 启动一个 goroutine 循环读取消息并投递到 channel 上，方便和其他事件一起 select
+// 控制帧在读取过程中内部处理，读取出错或连接关闭时错误会发送到错误 channel，然后两个 channel 都会被关闭
+// 调用方需要持续消费消息 channel，否则读取 goroutine 会阻塞在投递上；不再消费时关闭连接，
+// 读取 goroutine 就会放弃还没有投递的消息并退出，错误 channel 收到 net.ErrClosed
+func (c *Conn) ReadLoop() (<-chan Message, <-chan error) {
+	messages := make(chan Message)
+	errc := make(chan error, 1)
+
+	// 读取在新的 goroutine 中进行，它的调用栈里没有调用方，ReadWatchdog 记录的是调用 ReadLoop 的位置
+	site := readCallSite()
+	go func() {
+		defer close(errc)
+		defer close(messages)
+
+		for {
+			messageType, data, err := c.readDataAt(false, site)
+			if err != nil {
+				errc <- err
+				return
+			}
+			// 复用读缓冲区时数据会在下一次读取时被覆盖，投递之前先复制一份
+			if c.readBuf != nil {
+				data = append([]byte(nil), data...)
+			}
+			select {
+			case messages <- Message{Type: messageType, Data: data}:
+			case <-c.Context().Done():
+				errc <- net.ErrClosed
+				return
+			}
+		}
+	}()
+
+	return messages, errc
+}
+
+// 一个帧的帧头
+type frameHeader struct {
+	final      bool
+	compressed bool // RSV1 位
+	reserved   bool // RSV2 或 RSV3 位，目前没有支持任何定义了这两位的扩展
+	opcode     int
+	masked     bool
+	length     int64
+}
+
+// 读取一条完整的消息，分片的消息会把所有分片的 payload 拼接起来之后再返回
+func (c *Conn) readData(partial bool) (messageType int, data []byte, err error) {
+	return c.readDataAt(partial, "")
+}
+
+// 和 readData 相同，site 是 ReadWatchdog 记录的调用位置，为空时从调用栈中查找
+func (c *Conn) readDataAt(partial bool, site string) (messageType int, data []byte, err error) {
+	if c.closeErr != nil {
+		return 0, nil, c.closeErr
+	}
+	defer func() { c.readFailed(err) }()
+	if err := c.discardReader(); err != nil {
+		return 0, nil, err
+	}
+
+	if c.deadlineFunc != nil {
+		c.conn.SetReadDeadline(c.deadlineFunc(false))
+	}
+
+	// 读取一条消息的时间超过 watchdog 时长时记录一条警告，只用于排查阻塞问题，不会关闭连接
+	if c.readWatchdog > 0 {
+		if site == "" {
+			site = readCallSite()
+		}
+		timer := time.AfterFunc(c.readWatchdog, func() {
+			c.logger.Printf("Warning: conn %d (%s) read blocked for more than %s, called from %s",
+				c.id, c.conn.RemoteAddr(), c.readWatchdog, site)
+		})
+		defer timer.Stop()
+	}
+
+	// 正在读取的消息是否经过了 permessage-deflate 压缩
+	var compressed bool
+
+	// 读取消息期间占用的全局内存预算，消息读取结束后释放
+	// 被丢弃或者转交给 Request 的消息不会返回，继续读取下一条消息之前也要释放它占用的预算
+	var reserved int64
+	releaseReserved := func() {
+		if c.budget != nil {
+			c.budget.release(reserved)
+			reserved = 0
+		}
+	}
+	defer releaseReserved()
+
+	// 正在拼接的分片消息占用的全局分片数，消息拼接完成或者读取出错时释放
+	var fragmenting bool
+	releaseFragment := func() {
+		if fragmenting {
+			c.fragmentBudget.release()
+			fragmenting = false
+		}
+	}
+	defer releaseFragment()
+
+	// 拼接分片消息使用的缓冲区，从 assemblyPool 中取出，消息拼接完成或者读取出错时放回
+	var assembly *bytes.Buffer
+	releaseAssembly := func() {
+		if assembly != nil {
+			putAssemblyBuffer(assembly)
+			assembly = nil
+		}
+	}
+	defer releaseAssembly()
+
+	for {
+		h, err := c.nextDataFrame(messageType)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// 在分配内存之前检查消息长度，分片消息按所有分片的总长度计算，超过该类型消息的长度限制时以 1009 关闭连接
+		sizeType := messageType
+		if h.opcode != ContinuationFrame {
+			sizeType = h.opcode
+		}
+		// 用减法比较，避免分片很长时已读长度加上当前分片长度溢出成负数
+		if limit := c.messageSizeLimit(sizeType); limit > 0 && h.length > limit-int64(len(data)) {
+			c.CloseWithError(ErrMessageTooBig)
+			return 0, nil, ErrMessageTooBig
+		}
+
+		// 超出全局内存预算时以 1009 拒绝这条消息
+		if c.budget != nil {
+			if !c.budget.acquire(h.length) {
+				c.CloseWithError(ErrMessageTooBig)
+				return 0, nil, ErrMessageTooBig
+			}
+			reserved += h.length
+		}
+
+		// 分片消息的第一个分片到达时占用一个全局分片数，达到上限时以 1002 拒绝
+		if c.fragmentBudget != nil && h.opcode != ContinuationFrame && !h.final {
+			if !c.fragmentBudget.acquire() {
+				c.logger.Println("Too many fragmented messages in progress across connections")
+				c.CloseWithError(ErrProtocol)
+				return 0, nil, ErrProtocol
+			}
+			fragmenting = true
+		}
+
+		// 单帧的消息可以直接使用复用的读缓冲区，分片消息的每个分片都读到池中缓冲区的末尾，
+		// 缓冲区按需扩容，不需要每个分片单独分配内存再拼接
+		var p []byte
+		if h.opcode == ContinuationFrame || !h.final {
+			if assembly == nil {
+				assembly = getAssemblyBuffer()
+			}
+			err = c.readFrameInto(assembly, h)
+			data = assembly.Bytes()
+		} else {
+			p, err = c.readFramePayload(h, true)
+		}
+		if err != nil {
+			if !partial {
+				return 0, nil, err
+			}
+			if messageType == 0 {
+				messageType = h.opcode
+			}
+			return messageType, append(append([]byte(nil), data...), p...), err
+		}
+
+		if h.opcode != ContinuationFrame {
+			messageType = h.opcode
+			compressed = h.compressed
+			if h.final {
+				data = p
+			}
+		}
+
+		if !h.final {
+			continue
+		}
+		releaseFragment()
+
+		// 缓冲区要放回池中，拼接好的消息复制一份交给调用方，压缩的消息解压时本来就会产生新的数据，不需要复制
+		if assembly != nil && !compressed {
+			data = append([]byte(nil), data...)
+		}
+
+		// 压缩的消息在收到所有分片之后整体解压，解压后的长度同样受消息长度限制
+		if compressed {
+			data, err = decompressData(data, c.messageSizeLimit(messageType), c.dictionary)
+			if err != nil {
+				if err != ErrMessageTooBig {
+					c.logger.Printf("Failed to decompress message: %v", err)
+					err = ErrProtocol
+				}
+				c.CloseWithError(err)
+				return 0, nil, err
+			}
+		}
+		releaseAssembly()
+
+		// 文本消息必须是合法的 UTF-8，分片消息在拼接完整之后再检查，避免一个字符被拆在两个分片中时误判
+		// 二进制消息不做检查
+		if messageType == TextMessage && !utf8.Valid(data) {
+			c.logger.Println("Recived text message with invalid UTF-8")
+			c.CloseWithError(ErrInvalidUTF8)
+			return 0, nil, ErrInvalidUTF8
+		}
+
+		// 已经发送了 close 帧、还在等待对端回应 close 时，按照配置丢弃对端发来的数据
+		if c.discardAfterClose && c.isCloseSent() {
+			c.logger.Println("Discard data message received after close was sent")
+			messageType, data = 0, nil
+			releaseReserved()
+			continue
+		}
+
+		// 等待中的 Request 会直接拿走对应的响应，继续读取下一条消息
+		if messageType == TextMessage && c.deliverReply(messageType, data) {
+			messageType, data = 0, nil
+			releaseReserved()
+			continue
+		}
+
+		return messageType, data, nil
 	}
+}
+
+// 这个包的函数名前缀，比如 "main."，readCallSite 用它区分包内和包外的函数
+var packagePrefix = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	slash := strings.LastIndex(name, "/")
+	return name[:slash+1+strings.Index(name[slash+1:], ".")+1]
+}()
 
-	if frameType != TextMessage {
-		return nil, errors.New("only support text message")
+// 返回调用读取方法的位置，供 ReadWatchdog 记录
+// 跳过调用栈中这个包里 Conn 和 Router 的方法，这样经过 ReadDataContext、ReadGob、Router.Serve 等包装之后
+// 记录的仍然是真正的调用方，而不是固定深度上的某个包装函数
+func readCallSite() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, packagePrefix+"(*Conn).") && !strings.HasPrefix(f.Function, packagePrefix+"(*Router).") &&
+			!strings.HasPrefix(f.Function, "runtime.") {
+			return f.File + ":" + strconv.Itoa(f.Line)
+		}
+		// 以 go c.ReadData() 的方式在新的 goroutine 中直接调用时，调用栈里找不到调用方
+		if !more {
+			return "unknown"
+		}
 	}
+}
+
+// 读取下一个数据帧的帧头并检查它是否合法，期间收到的控制帧都在这里处理掉
+// messageType 是正在读取的分片消息的类型，还没有开始读取消息时为 0
+func (c *Conn) nextDataFrame(messageType int) (frameHeader, error) {
+	for {
+		h, err := c.readFrameHeader()
+		if err != nil {
+			return h, err
+		}
 
-	mask := b[1]&maskBit != 0
+		// 客户端发送给服务端的帧必须经过掩码处理，服务端发送给客户端的帧则不能带掩码
+		// 协商了 x-no-mask 时服务端带不带掩码的帧都接受
+		if c.isServer && !h.masked && !c.noMask {
+			c.logger.Println("Recived unmasked frame from client")
+			c.CloseWithError(ErrProtocol)
+			return h, ErrProtocol
+		}
+		if !c.isServer && h.masked {
+			c.logger.Println("Recived masked frame from server")
+			c.CloseWithError(ErrProtocol)
+			return h, ErrProtocol
+		}
+
+		// 控制帧的 payload 不能超过 125 字节（或者 SetMaxControlFramePayload 设置的更小的限制）
+		if h.opcode >= CloseMessage && h.length > c.maxControlPayload {
+			c.logger.Printf("Recived control frame with %d bytes payload, exceeds limit %d", h.length, c.maxControlPayload)
+			c.CloseWithError(ErrProtocol)
+			return h, ErrProtocol
+		}
+
+		// 控制帧不能分片，FIN 位必须为 1
+		if h.opcode >= CloseMessage && !h.final {
+			c.logger.Println("Recived fragmented control frame")
+			c.CloseWithError(ErrProtocol)
+			return h, ErrProtocol
+		}
+
+		// RSV 位只能由协商好的扩展使用，没有扩展定义的 RSV 位被设置时以 1002 关闭连接
+		// 目前只有 permessage-deflate 使用 RSV1，并且只能出现在数据消息的第一个帧中，控制帧和后续分片都不能设置
+		if h.reserved || (h.compressed && !c.compression) {
+			c.logger.Println("Recived frame with reserved bits set but no extension negotiated")
+			c.CloseWithError(ErrProtocol)
+			return h, ErrProtocol
+		}
+		if h.compressed && (h.opcode == ContinuationFrame || h.opcode >= CloseMessage) {
+			c.logger.Println("Recived RSV1 on a control or continuation frame")
+			c.CloseWithError(ErrProtocol)
+			return h, ErrProtocol
+		}
+
+		switch h.opcode {
+		case CloseMessage, PingMessage, PongMessage:
+			if err := c.handleControlFrame(h); err != nil {
+				return h, err
+			}
+			continue
+		case ContinuationFrame:
+			if messageType == 0 {
+				c.logger.Println("Recived continuation frame without a preceding fragmented message")
+				c.CloseWithError(ErrProtocol)
+				return h, ErrProtocol
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				c.logger.Println("Recived new data frame before the fragmented message is finished")
+				c.CloseWithError(ErrProtocol)
+				return h, ErrProtocol
+			}
+		default:
+			// 3-7 和 0xB-0xF 是保留的 opcode，没有扩展定义它们时以 1002 关闭连接
+			c.logger.Printf("Recived frame with reserved opcode %d", h.opcode)
+			c.CloseWithError(ErrProtocol)
+			return h, ErrProtocol
+		}
+
+		c.markDataActivity()
+		return h, nil
+	}
+}
+
+// 读取并处理一个控制帧，返回 nil 时表示可以继续读取下一个帧
+func (c *Conn) handleControlFrame(h frameHeader) error {
+	p, err := c.readFramePayload(h, false)
+	if err != nil {
+		return err
+	}
+
+	switch h.opcode {
+	case CloseMessage:
+		// close 帧的 payload 和数据帧一样经过了掩码处理，解码之后才能解析出状态码和原因
+		// payload 要么为空，要么至少包含 2 字节的状态码
+		if len(p) == 1 {
+			c.CloseWithError(ErrProtocol)
+			return ErrProtocol
+		}
+		code, reason := parseClosePayload(p)
+		if c.strictCloseCodes && len(p) > 0 && !isValidReceivedCloseCode(int(code)) {
+			c.CloseWithError(ErrProtocol)
+			return ErrProtocol
+		}
+		// close 帧之后的数据都应该被忽略，丢弃已经读进缓冲区的字节，之后的读取直接返回 close 错误
+		c.br.Discard(c.br.Buffered())
+		// 还没有发送过 close 帧时需要回应一个 close 帧，对端没有给出状态码时回应的 close 帧也不带状态码
+		// 1005、1006、1015 等不能出现在 close 帧中的状态码不能原样发回去，改为回应 1000
+		// 已经发送过时 WriteControl 会返回 ErrCloseSent，这就是对我们那个 close 帧的回应
+		var reply []byte
+		switch {
+		case len(p) == 0:
+		case !isValidReceivedCloseCode(int(code)):
+			reply = closePayload(CloseNormalClosure, "")
+		default:
+			reply = closePayload(code, "")
+		}
+		c.WriteControl(CloseMessage, reply, time.Now().Add(closeWriteTimeout))
+		c.Close()
+		c.logger.Printf("Recived closed message, code: %d, reason: %s, connection will be closed", code, reason)
+		c.closeErr = &CloseError{Code: code, Reason: reason}
+		return c.closeErr
+	case PingMessage:
+		if c.pingHandler != nil {
+			return c.pingHandler(p)
+		}
+		// 默认用相同的数据回复 pong，然后继续读取下一个帧，已经发送过 close 帧时也会回复
+		if err := c.writeControl(PongMessage, p); err != nil {
+			return err
+		}
+	case PongMessage:
+		// keepalive 的序号不管有没有设置 pong 处理函数都要记录
+		c.handleKeepalivePong(p)
+		if c.pongHandler != nil {
+			return c.pongHandler(p)
+		}
+	}
+	return nil
+}
 
-	payloadLen := int64(b[1] & 0x7F)
-	dataLen := int64(payloadLen)
+// 读取一个帧的帧头，包括扩展长度和 mask key
+func (c *Conn) readFrameHeader() (h frameHeader, err error) {
+	// b 只保存 2 字节的帧头，扩展长度单独读到 ext 中，
+	// 避免读取扩展长度时覆盖掉帧头，也保证了 扩展长度 -> mask key -> payload 的读取顺序不会被改乱
+	var b [2]byte
+	var ext [8]byte
+
+	if _, err := io.ReadFull(c.br, b[:]); err != nil {
+		return h, err
+	}
+
+	// 提取FIN位
+	h.final = b[0]&finalBit != 0
+	h.compressed = b[0]&rsv1Bit != 0
+	h.reserved = b[0]&(rsv2Bit|rsv3Bit) != 0
+	h.opcode = int(b[0] & opCodeMask)
+	h.masked = b[1]&maskBit != 0
+
+	payloadLen := int64(b[1] & payloadLenMask)
+	h.length = payloadLen
 
 	// 根据payload length 判断数据的真实长度
 	switch payloadLen {
 	case 126:
-		if _, err := c.conn.Read(b[:2]); err != nil {
-			return nil, err
+		if _, err := io.ReadFull(c.br, ext[:2]); err != nil {
+			return h, err
 		}
-		dataLen = int64(binary.BigEndian.Uint16(b[:2]))
+		h.length = int64(binary.BigEndian.Uint16(ext[:2]))
 	case 127:
-		if _, err := c.conn.Read(b[:8]); err != nil {
-			return nil, err
+		if _, err := io.ReadFull(c.br, ext[:8]); err != nil {
+			return h, err
 		}
-		dataLen = int64(binary.BigEndian.Uint64(b[:8]))
+		// 规范要求 64 位长度的最高位必须为 0，转换成 int64 之后也就不会是负数，
+		// 同时长度还要能放进 int，否则在 32 位平台上分配内存时会出错
+		length := binary.BigEndian.Uint64(ext[:8])
+		if length>>63 != 0 || length > uint64(math.MaxInt) {
+			c.logger.Printf("Recived invalid 64-bit payload length %d", length)
+			c.CloseWithError(ErrProtocol)
+			return h, ErrProtocol
+		}
+		h.length = int64(length)
 	}
 
-	log.Printf("Read data length: %d, payload length %d", payloadLen, dataLen)
+	c.emitFrameInfo(FrameInfo{
+		Opcode:     h.opcode,
+		Fin:        h.final,
+		Length:     h.length,
+		Masked:     h.masked,
+		Compressed: h.compressed,
+	})
 
 	// 读取 mask key
-	if mask {
-		if _, err := c.conn.Read(c.maskKey[:]); err != nil {
-			return nil, err
+	if h.masked {
+		if _, err := io.ReadFull(c.br, c.maskKey[:]); err != nil {
+			return h, err
 		}
 	}
 
-	// 读取数据内容
-	p := make([]byte, dataLen)
-	if _, err := c.conn.Read(p); err != nil {
-		return nil, err
+	return h, nil
+}
+
+// 读取一个帧的 payload 并解除掩码，出错时返回已经读到的部分
+// reuse 为 true 并且长度不超过复用缓冲区时直接使用它，避免每条消息都重新分配内存
+func (c *Conn) readFramePayload(h frameHeader, reuse bool) ([]byte, error) {
+	var p []byte
+	if reuse && h.length <= int64(len(c.readBuf)) {
+		p = c.readBuf[:h.length]
+	} else {
+		p = make([]byte, h.length)
 	}
-	if mask {
-		maskBytes(c.maskKey, p)
+
+	n, err := io.ReadFull(c.br, p)
+	if h.masked {
+		maskBytes(c.maskKey, 0, p[:n])
 	}
+	return p[:n], err
+}
 
-	return p, nil
+// 读取一个帧的 payload 并解除掩码，追加到 buf 的末尾，出错时 buf 中包含已经读到的部分
+func (c *Conn) readFrameInto(buf *bytes.Buffer, h frameHeader) error {
+	buf.Grow(int(h.length))
+	p := buf.AvailableBuffer()[:h.length]
+	n, err := io.ReadFull(c.br, p)
+	if h.masked {
+		maskBytes(c.maskKey, 0, p[:n])
+	}
+	buf.Write(p[:n])
+	return err
 }
 
-// 协议从http上升到websocket
+// 放回 assemblyPool 的缓冲区的最大容量，偶尔收到一条很大的分片消息时不保留它的缓冲区
+const maxPooledAssemblyBuf = 4 << 20
+
+// 所有连接共用的拼接分片消息的缓冲区
+var assemblyPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getAssemblyBuffer() *bytes.Buffer {
+	buf := assemblyPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putAssemblyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledAssemblyBuf {
+		assemblyPool.Put(buf)
+	}
+}
+
+// 返回某种类型消息的长度限制，没有单独设置时使用 maxMessageSize，控制帧不受限制，小于等于 0 时不限制
+func (c *Conn) messageSizeLimit(messageType int) int64 {
+	switch {
+	case messageType == TextMessage && c.maxTextMessageSize > 0:
+		return c.maxTextMessageSize
+	case messageType == BinaryMessage && c.maxBinaryMessageSize > 0:
+		return c.maxBinaryMessageSize
+	case messageType == TextMessage || messageType == BinaryMessage:
+		return c.maxMessageSize
+	}
+	return 0
+}
+
+// 解析 close 帧的 payload：前两个字节是大端序的状态码，剩下的是 UTF-8 编码的原因
+// payload 中没有状态码时按照规范视为 1005
+func parseClosePayload(p []byte) (code uint16, reason string) {
+	if len(p) < 2 {
+		return CloseNoStatusReceived, ""
+	}
+	return binary.BigEndian.Uint16(p[:2]), string(p[2:])
+}
+
+// 协议升级的配置
+type Upgrader struct {
+	// 写入 101 响应的超时时间，为 0 时不设置超时
+	HandshakeWriteTimeout time.Duration
+
+	// 大于 0 时为每个连接分配一块该长度的读缓冲区，不超过该长度的消息都复用这块缓冲区，
+	// 更大的消息仍然单独分配。启用后 ReadData 返回的数据只在下一次读取之前有效
+	InitialReadBuffer int
+
+	// 开启后会拒绝解码后为全零或者简单重复字节的 Sec-WebSocket-Key，默认关闭
+	StrictKeyCheck bool
+
+	// 文本消息和二进制消息各自的最大长度，超过时以 1009 关闭连接，为 0 时使用 MaxMessageSize 的限制
+	MaxTextMessageSize   int64
+	MaxBinaryMessageSize int64
+
+	// 消息的最大长度，没有单独设置 MaxTextMessageSize 或 MaxBinaryMessageSize 时使用，
+	// 超过时在分配内存之前就以 1009 关闭连接。为 0 时使用默认的 32MB，小于 0 时不限制
+	MaxMessageSize int64
+
+	// 所有连接共享的内存预算，可以在多个 Upgrader 之间共享，为 nil 时不限制
+	MemoryBudget *MemoryBudget
+
+	// 所有连接同时在拼接中的分片消息数的上限，达到上限时新开始的分片消息会以 1002 关闭连接，
+	// 可以在多个 Upgrader 之间共享，为 nil 时不限制。NextReader 不缓存分片，不受这个限制
+	FragmentBudget *FragmentBudget
+
+	// 开启后收到未定义或保留的 close 状态码（比如 1004）时以 1002 关闭连接，
+	// 默认关闭，此时任何状态码都会被接受，以便兼容使用自定义状态码的应用
+	StrictCloseCodes bool
+
+	// 开启后，在发送 close 帧之后、收到对端回应的 close 帧之前收到的数据帧都会被丢弃
+	// 默认关闭，这样 CloseWrite 之后仍然可以读到对端在关闭前发送的最后几条消息
+	DiscardDataAfterClose bool
+
+	// 不为 nil 时会收到从底层连接读到的 / 写出的所有原始字节，可用于录制流量
+	// 握手请求在升级之前已经被 net/http 读取，所以 RecordRead 只能记录到握手之后的数据，
+	// RecordWrite 则包含 101 响应
+	RecordRead  io.Writer
+	RecordWrite io.Writer
+
+	// 握手限速器，超过限制的握手请求会被直接以 503 拒绝，可以在多个 Upgrader 之间共享，为 nil 时不限制
+	HandshakeLimiter *RateLimiter
+
+	// 仅用于测试的延迟注入配置，只有使用 -tags chaos 编译时才会生效，见 ChaosConfig
+	Chaos *ChaosConfig
+
+	// 大于 0 时，一次读取消息的时间超过该时长会记录一条包含连接编号和调用位置的警告
+	// 警告通过 Logger 输出，没有设置 Logger 时什么都不会记录，所以需要同时设置 Logger
+	ReadWatchdog time.Duration
+
+	// 服务端支持的子协议，会按照客户端在 Sec-WebSocket-Protocol 中给出的顺序选择第一个双方都支持的子协议
+	Subprotocols []string
+
+	// 开启后，没有协商出双方都支持的子协议时（包括客户端没有提供任何子协议）以 400 拒绝握手，
+	// 而不是不带子协议继续升级，避免依赖子协议的客户端在不知情的情况下使用了错误的协议
+	RequireSubprotocol bool
+
+	// 检查请求的 Origin，返回 false 时以 403 拒绝握手，防止其他网站在用户浏览器中跨站连接
+	// 为 nil 时使用默认的检查：没有 Origin 请求头（非浏览器客户端）或者 Origin 的 host 和请求的 Host 相同时允许
+	CheckOrigin func(r *http.Request) bool
+
+	// 开启后，客户端在 Sec-WebSocket-Extensions 中提供了参数可以满足的 permessage-deflate 时启用压缩，
+	// 发送的消息都会被压缩，收到的压缩消息会被解压。只支持 no context takeover，每条消息都单独压缩
+	EnableCompression bool
+
+	// 设置后，客户端提供了使用内容相同的字典的 x-deflate-dictionary 时，以这个字典压缩和解压消息，见 CompressionDictionary
+	// 不需要同时开启 EnableCompression，两个都设置时按照客户端提供的顺序选择
+	CompressionDictionary *CompressionDictionary
+
+	// 开启后，客户端在 Sec-WebSocket-Extensions 中提供了 x-no-mask 时接受它，之后接受客户端发送的不带掩码的帧，
+	// 客户端省掉了给每个字节做异或的开销。注意这不符合 RFC 6455，默认关闭，
+	// 只能用于两端都由自己控制、中间没有代理的可信内网，面向浏览器或者公网的服务不能开启
+	AllowNoMask bool
+
+	// 握手过程和升级后的连接输出内部日志使用的 Logger，比如收到不合法的帧、收到 close 帧等，
+	// 为 nil 时不输出任何日志，需要时可以设置为 log.Default()
+	Logger Logger
+}
+
+// 默认的消息最大长度
+const defaultMaxMessageSize = 32 << 20
+
+// 用于给连接分配编号
+var connID uint64
+
+// 创建一个握手已经完成的连接，服务端和客户端共用
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool) *Conn {
+	c := &Conn{
+		conn:              conn,
+		br:                br,
+		isServer:          isServer,
+		upgradedAt:        time.Now(),
+		maxControlPayload: maxControlFramePayload,
+		maxMessageSize:    defaultMaxMessageSize,
+		logger:            nopLogger{},
+		id:                atomic.AddUint64(&connID, 1),
+	}
+	c.lastDataAt.Store(c.upgradedAt.UnixNano())
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// 默认的协议升级配置
+var defaultUpgrader = &Upgrader{
+	HandshakeWriteTimeout: 10 * time.Second,
+}
+
+// 使用默认配置将协议从http上升到websocket
 func upgrade(w http.ResponseWriter, r *http.Request) (c *Conn, err error) {
+	return defaultUpgrader.Upgrade(w, r)
+}
+
+// 协议从http上升到websocket
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (c *Conn, err error) {
 
 	/*
 		一个ws request 请求的格式
@@ -176,6 +1297,12 @@ func upgrade(w http.ResponseWriter, r *http.Request) (c *Conn, err error) {
 		User-Agent:Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/61.0.3163.100 Safari/537.36
 	*/
 
+	// 握手需要计算 SHA-1，开销比建立连接大得多，超过限速时在做任何检查之前就直接拒绝
+	if u.HandshakeLimiter != nil && !u.HandshakeLimiter.Allow() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, errors.New("websocket: handshake rate limit exceeded")
+	}
+
 	if r.Method != "GET" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return nil, errors.New("websocket: method not GET")
@@ -198,13 +1325,45 @@ func upgrade(w http.ResponseWriter, r *http.Request) (c *Conn, err error) {
 		return nil, errors.New("websocket: could not find connection header with token 'websocket'")
 	}
 
-	challengeKey := r.Header.Get("Sec-Websocket-Key")
+	// 只能有一个 Sec-WebSocket-Key，否则无法确定应该用哪个计算 Sec-WebSocket-Accept
+	if len(headerValues(r.Header, "Sec-Websocket-Key")) > 1 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, errors.New("websocket: duplicate Sec-WebSocket-Key header")
+	}
+
+	challengeKey := headerValue(r.Header, "Sec-Websocket-Key")
 
 	if challengeKey == "" {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return nil, errors.New("websocket: key missing or blank")
 	}
 
+	if !isValidChallengeKey(challengeKey) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, errors.New("websocket: key is not base64 encoded 16 bytes")
+	}
+
+	if u.StrictKeyCheck && !isSaneChallengeKey(challengeKey) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, errors.New("websocket: key is malformed or trivially repeated")
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, errors.New("websocket: request origin not allowed by Upgrader.CheckOrigin")
+	}
+
+	// 子协议需要在劫持连接之前选出，这样 RequireSubprotocol 才能返回 400
+	subprotocol := u.selectSubprotocol(r)
+	if subprotocol == "" && u.RequireSubprotocol {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, errors.New("websocket: no mutually supported subprotocol, required by Upgrader.RequireSubprotocol")
+	}
+
 	h, ok := w.(http.Hijacker)
 
 	if !ok {
@@ -219,36 +1378,210 @@ func upgrade(w http.ResponseWriter, r *http.Request) (c *Conn, err error) {
 		return nil, err
 	}
 
-	br := rw.Reader
+	// 客户端可能紧跟在握手请求之后就发送了第一个帧（比如 HTTP pipelining，或者和请求在同一个 TLS record 中），
+	// 这些数据已经被 net/http 读进了 rw.Reader，读取连接时要先读这部分数据，不能丢掉
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ := rw.Reader.Peek(n)
+		conn = &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buffered), conn)}
+	}
 
-	if br.Buffered() > 0 {
-		conn.Close()
-		return nil, errors.New("websocket: client sent data before handshake is complete")
+	conn = wrapChaos(conn, u.Chaos)
+
+	if u.RecordRead != nil || u.RecordWrite != nil {
+		conn = newRecordingConn(conn, u.RecordRead, u.RecordWrite)
 	}
 
-	p := []byte{}
-	p = append(p,
-		"HTTP/1.1 101 Switching Protocols\r\n"+ // 返回http 101 状态码切换协议
-			"Upgrade: websocket\r\n"+
-			"Connection: Upgrade\r\n"+
-			"Sec-WebSocket-Accept: "+computeAcceptKey(challengeKey)+
-			"\r\n\r\n"...)
+	// 逐行写入响应头，每一行都以 \r\n 结尾，最后用一个空行结束响应头
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\n") // 返回http 101 状态码切换协议
+	writeHeaderLine(&resp, "Upgrade", "websocket")
+	writeHeaderLine(&resp, "Connection", "Upgrade")
+	writeHeaderLine(&resp, "Sec-WebSocket-Accept", computeAcceptKey(challengeKey))
+
+	// 只有协商出了双方都支持的子协议时才返回 Sec-WebSocket-Protocol
+	if subprotocol != "" {
+		writeHeaderLine(&resp, "Sec-WebSocket-Protocol", subprotocol)
+	}
+	extension, dict := u.selectCompression(r)
+	noMask := u.AllowNoMask && offersNoMask(r)
+	var extensions []string
+	if extension != "" {
+		extensions = append(extensions, extension)
+	}
+	if noMask {
+		extensions = append(extensions, noMaskExtension)
+	}
+	if len(extensions) > 0 {
+		writeHeaderLine(&resp, "Sec-WebSocket-Extensions", strings.Join(extensions, ", "))
+	}
+	resp.WriteString("\r\n")
 
-	if _, err := conn.Write(p); err != nil {
+	// 写入响应时设置超时，避免客户端一直不读取响应时阻塞住服务端
+	if u.HandshakeWriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(u.HandshakeWriteTimeout))
+	}
+
+	if _, err := conn.Write(resp.Bytes()); err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	log.Println("Upgrade http to websocket successfully")
+	conn.SetWriteDeadline(time.Time{})
+
+	u.logger().Println("Upgrade http to websocket successfully")
 
 	// 实例化我们定义的数据对象
-	newConn := &Conn{conn: conn}
+	newConn := newConn(conn, bufio.NewReader(conn), true)
+	newConn.maxTextMessageSize = u.MaxTextMessageSize
+	newConn.maxBinaryMessageSize = u.MaxBinaryMessageSize
+	if u.MaxMessageSize != 0 {
+		newConn.maxMessageSize = u.MaxMessageSize
+	}
+	newConn.budget = u.MemoryBudget
+	newConn.fragmentBudget = u.FragmentBudget
+	newConn.strictCloseCodes = u.StrictCloseCodes
+	newConn.discardAfterClose = u.DiscardDataAfterClose
+	newConn.readWatchdog = u.ReadWatchdog
+	newConn.subprotocol = subprotocol
+	newConn.logger = u.logger()
+	for _, ext := range extensions {
+		newConn.extensions = append(newConn.extensions, parseExtension(ext))
+	}
+	newConn.noMask = noMask
+	newConn.compression = extension != ""
+	if newConn.compression {
+		newConn.dictionary = dict
+		newConn.compressionInfo = negotiatedCompression
+		if dict != nil {
+			newConn.compressionInfo.Dictionary = dict.id
+			newConn.compressionInfo.Level = dictionaryCompressionLevel
+		}
+		newConn.logger.Printf("Conn %d negotiated %s: %+v", newConn.id, parseExtension(extension).Name, newConn.compressionInfo)
+	}
+	if u.InitialReadBuffer > 0 {
+		newConn.readBuf = make([]byte, u.InitialReadBuffer)
+	}
 
 	return newConn, nil
 }
 
+// 默认的 Origin 检查，只允许同源的请求和没有 Origin 请求头的请求
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// 劫持连接时已经被读进缓冲区的数据，读取时先返回这些数据，读完之后再从底层连接读取
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// 写入一行 "name: value\r\n" 格式的响应头
+func writeHeaderLine(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteString("\r\n")
+}
+
+// 按照客户端给出的顺序，选择第一个服务端也支持的子协议，没有时返回空字符串
+func (u *Upgrader) selectSubprotocol(r *http.Request) string {
+	for _, offered := range headerTokens(r.Header, "Sec-Websocket-Protocol") {
+		for _, supported := range u.Subprotocols {
+			if offered == supported {
+				return offered
+			}
+		}
+	}
+	return ""
+}
+
+// 把请求头中以逗号分隔的值拆成列表，同一个请求头出现多次时会合并起来
+func headerTokens(headers http.Header, field string) []string {
+	var tokens []string
+	for _, value := range headers[http.CanonicalHeaderKey(field)] {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// 检查 key 是否是 base64 编码的 16 个字节，参见 RFC 6455 4.2.1
+func isValidChallengeKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(b) == 16
+}
+
+// 检查 key 能否被 base64 解码，并且解码后不是全零或者简单重复的字节
+func isSaneChallengeKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) == 0 {
+		return false
+	}
+
+	// 以 1、2、4、8 字节为周期重复的内容都视为无效，全零的 key 也属于这种情况
+	for _, period := range []int{1, 2, 4, 8} {
+		if len(b) > period && len(b)%period == 0 && bytes.Equal(b[period:], b[:len(b)-period]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 读取请求头，先按规范化后的名字查找，找不到时再忽略大小写遍历所有请求头，
+// 兼容手动设置了非规范化请求头的客户端
+func headerValue(headers http.Header, field string) string {
+	if value := headers.Get(field); value != "" {
+		return value
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, field) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// 返回某个请求头的所有值，和 headerValue 一样忽略名字的大小写
+func headerValues(headers http.Header, field string) []string {
+	var values []string
+	for k, v := range headers {
+		if strings.EqualFold(k, field) {
+			values = append(values, v...)
+		}
+	}
+	return values
+}
+
+// 判断以逗号分隔的请求头中是否包含某个值，比较时忽略大小写，
+// 比如 "Connection: keep-alive, Upgrade" 也包含 upgrade
 func tokenListContainsValue(headers http.Header, field string, value string) bool {
-	return strings.ToLower(headers.Get(field)) == value
+	for _, token := range headerTokens(headers, field) {
+		if strings.EqualFold(token, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// index 页面的模板数据
+type indexData struct {
+	WebSocketURL string // 页面中的 js 连接的 websocket 地址
 }
 
 // index 页面处理器
@@ -257,37 +1590,69 @@ func index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		log.Println("载入页面失败")
 	} else {
-		t.Execute(w, nil)
+		t.Execute(w, indexData{WebSocketURL: webSocketURL(r)})
 	}
 }
 
-// 回声函数
-func echo(w http.ResponseWriter, r *http.Request) {
-
-	// 协议升级
-	c, err := upgrade(w, r)
-
-	if err != nil {
-		log.Print("Upgrade error:", err)
-		return
+// 根据请求的 Host 计算回声程序的 websocket 地址，请求经过 TLS 或者代理声明了 https 时使用 wss
+func webSocketURL(r *http.Request) string {
+	scheme := "ws"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "wss"
 	}
+	return scheme + "://" + r.Host + "/echo"
+}
 
-	defer c.conn.Close()
+// 所有 echo 连接，服务退出时用它关闭这些连接
+var registry = NewConnRegistry()
+
+// 回声函数
+// 把收到的消息原样发回去，协议升级和关闭连接由 Handler 负责
+func echo(c *Conn) {
+	registry.Register(c)
+	defer registry.Unregister(c)
 
 	for {
-		message, err := c.ReadData()
+		messageType, message, err := c.ReadMessage()
 		if err != nil {
 			log.Println("read:", err)
 			break
 		}
 		log.Printf("recv: %s", message)
-		c.SendData(message)
+		if err := c.WriteMessage(messageType, message); err != nil {
+			log.Println("write:", err)
+			break
+		}
 	}
 }
 
 func main() {
 	log.SetFlags(1)
+	// Handler 使用默认配置升级协议，让升级失败等内部日志输出到标准日志
+	defaultUpgrader.Logger = log.Default()
 	http.HandleFunc("/", index)
-	http.HandleFunc("/echo", echo)
-	log.Fatal(http.ListenAndServe("0.0.0.0:8080", nil))
+	http.Handle("/echo", Handler(echo))
+
+	// 需要 wss:// 时改用 server.ListenAndServeTLS(certFile, keyFile)，
+	// Upgrade 劫持到的就是 *tls.Conn，帧的读写不需要任何改动
+	server := &http.Server{Addr: "0.0.0.0:8080"}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// 收到 Ctrl-C 或 SIGTERM 时停止接受新的请求，并以 1001 关闭所有的 websocket 连接
+	// 被劫持的连接不归 http.Server 管理，所以 server.Shutdown 不会等待它们，需要另外通过 registry 关闭
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	if err := registry.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+	}
 }
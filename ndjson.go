@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// ReadNDJSON 的读取模式
+const (
+	NDJSONPerFrame = iota // 每个文本帧是一个 JSON 对象
+	NDJSONPerLine         // 每个文本帧中可以有多行，每一行是一个 JSON 对象
+)
+
+var errInvalidNDJSON = errors.New("websocket: invalid json in ndjson stream")
+
+// 启动一个 goroutine 把收到的文本消息按照 NDJSON（以换行分隔的 JSON）解析，并把每个 JSON 对象投递到 channel 上
+// 读取出错或者遇到不合法的 JSON 时错误会发送到错误 channel，然后两个 channel 都会被关闭
+// 和 ReadLoop 一样，调用方不再消费时关闭连接，读取 goroutine 就会退出，错误 channel 收到 net.ErrClosed
+func (c *Conn) ReadNDJSON(mode int) (<-chan json.RawMessage, <-chan error) {
+	objects := make(chan json.RawMessage)
+	errc := make(chan error, 1)
+
+	// 和 ReadLoop 一样，ReadWatchdog 记录的是调用 ReadNDJSON 的位置
+	site := readCallSite()
+	go func() {
+		defer close(errc)
+		defer close(objects)
+
+		for {
+			messageType, data, err := c.readDataAt(false, site)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if messageType != TextMessage {
+				continue
+			}
+
+			lines := [][]byte{data}
+			if mode == NDJSONPerLine {
+				lines = bytes.Split(data, []byte("\n"))
+			}
+			for _, line := range lines {
+				line = bytes.TrimSpace(line)
+				if len(line) == 0 {
+					continue
+				}
+				if !json.Valid(line) {
+					errc <- errInvalidNDJSON
+					return
+				}
+				// 复用读缓冲区时数据会在下一次读取时被覆盖，投递之前先复制一份
+				select {
+				case objects <- json.RawMessage(append([]byte(nil), line...)):
+				case <-c.Context().Done():
+					errc <- net.ErrClosed
+					return
+				}
+			}
+		}
+	}()
+
+	return objects, errc
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadNDJSON(t *testing.T) {
+	tests := []struct {
+		mode int
+		want []string
+	}{
+		{NDJSONPerFrame, []string{`{"a":1}`, `{"b":[2,3]}`}},
+		{NDJSONPerLine, []string{`{"a":1}`, `{"b":[2,3]}`, `{"c":4}`}},
+	}
+	for _, tt := range tests {
+		c, peer := newTestServerConn()
+		second := `{"b":[2,3]}`
+		if tt.mode == NDJSONPerLine {
+			second += "\n\n{\"c\":4}\n"
+		}
+		finish := runTestPeer(peer, [][]byte{
+			clientFrame(finalBit|TextMessage, []byte(`{"a":1}`)),
+			clientFrame(finalBit|BinaryMessage, []byte("skipped")),
+			clientFrame(finalBit|TextMessage, []byte(second)),
+			clientFrame(finalBit|CloseMessage, closePayload(CloseNormalClosure, "")),
+		})
+
+		objects, errc := c.ReadNDJSON(tt.mode)
+		var got []string
+		for obj := range objects {
+			got = append(got, string(obj))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mode %d: objects = %q, want %q", tt.mode, got, tt.want)
+		}
+		var closeErr *CloseError
+		if err := <-errc; !errors.As(err, &closeErr) {
+			t.Errorf("mode %d: error = %v, want a close error", tt.mode, err)
+		}
+		finish()
+		c.Close()
+	}
+}
+
+func TestReadNDJSONInvalid(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|TextMessage, []byte("{\"a\":1}\n{oops"))})
+	defer finish()
+
+	objects, errc := c.ReadNDJSON(NDJSONPerLine)
+	if obj := <-objects; string(obj) != `{"a":1}` {
+		t.Fatalf("first object = %s, want {\"a\":1}", obj)
+	}
+	if err := <-errc; err != errInvalidNDJSON {
+		t.Fatalf("error = %v, want errInvalidNDJSON", err)
+	}
+}
+
+func TestReadNDJSONExitsWhenConnClosed(t *testing.T) {
+	c, peer := newTestServerConn()
+	frames := c.DebugFrames()
+	finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|TextMessage, []byte("{\"a\":1}\n{\"b\":2}"))})
+	defer finish()
+
+	// 不消费任何对象，读取 goroutine 阻塞在投递第一个对象上，关闭连接之后它必须退出
+	objects, errc := c.ReadNDJSON(NDJSONPerLine)
+	<-frames
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("error = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadNDJSON goroutine did not exit after Close")
+	}
+	if _, ok := <-objects; ok {
+		t.Fatal("objects channel is still open")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 令牌桶限速器，用来限制每秒接受的握手数量
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒补充的令牌数
+	burst  float64 // 桶的容量
+	tokens float64
+	last   time.Time
+}
+
+// 创建一个每秒补充 perSecond 个令牌、最多积攒 burst 个令牌的限速器
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// 尝试取出一个令牌，桶中没有令牌时返回 false
+func (l *RateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
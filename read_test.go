@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 不断重复输出同一段数据的 io.Reader，用于在 benchmark 中源源不断地提供同样的帧
+type repeatReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.pos:])
+		n += c
+		r.pos = (r.pos + c) % len(r.data)
+	}
+	return n, nil
+}
+
+// 创建一个不断读到 data 中的帧的服务端 Conn
+func newRepeatReaderConn(data []byte) *Conn {
+	a, _ := net.Pipe()
+	return newConn(a, bufio.NewReader(&repeatReader{data: data}), true)
+}
+
+func TestReadDataPartial(t *testing.T) {
+	f := clientFrame(finalBit|TextMessage, []byte("hello world"))
+
+	// 只发送帧头、mask key 和 payload 的前 5 个字节，然后断开连接
+	for _, partial := range []bool{false, true} {
+		c, peer := newTestServerConn()
+		go func() {
+			peer.Write(f[:len(f)-6])
+			peer.Close()
+		}()
+
+		var data []byte
+		var err error
+		if partial {
+			data, err = c.ReadDataPartial()
+		} else {
+			data, err = c.ReadData()
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("partial=%v: error = %v, want io.ErrUnexpectedEOF", partial, err)
+		}
+		want := ""
+		if partial {
+			want = "hello"
+		}
+		if string(data) != want {
+			t.Fatalf("partial=%v: data = %q, want %q", partial, data, want)
+		}
+		c.Close()
+	}
+}
+
+func BenchmarkReadDataInitialReadBuffer(b *testing.B) {
+	frame := clientFrame(finalBit|BinaryMessage, make([]byte, 1024))
+	for _, size := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("InitialReadBuffer=%d", size), func(b *testing.B) {
+			c := newRepeatReaderConn(frame)
+			defer c.Close()
+			if size > 0 {
+				c.readBuf = make([]byte, size)
+			}
+			b.ReportAllocs()
+			b.SetBytes(1024)
+			for i := 0; i < b.N; i++ {
+				if _, err := c.ReadData(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// 比较重组一条 1MB、100 个分片的消息的两种方式：
+// PooledBuffer 是 ReadData 的做法，分片累积在池中的 bytes.Buffer 里，最后复制一份交给调用方；
+// Append 从一个新的空切片开始不断 append 每次读到的数据，是改用缓冲池之前的做法
+func BenchmarkReadDataFragmented(b *testing.B) {
+	const size, fragments = 1 << 20, 100
+	payload := make([]byte, size)
+	var data []byte
+	for i := 0; i < fragments; i++ {
+		b0 := byte(ContinuationFrame)
+		if i == 0 {
+			b0 = BinaryMessage
+		}
+		if i == fragments-1 {
+			b0 |= finalBit
+		}
+		data = append(data, clientFrame(b0, payload[i*size/fragments:(i+1)*size/fragments])...)
+	}
+
+	reads := []struct {
+		name string
+		read func(c *Conn) ([]byte, error)
+	}{
+		{"PooledBuffer", (*Conn).ReadData},
+		{"Append", func(c *Conn) ([]byte, error) {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(r)
+		}},
+	}
+	for _, read := range reads {
+		b.Run(read.name, func(b *testing.B) {
+			c := newRepeatReaderConn(data)
+			defer c.Close()
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				p, err := read.read(c)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(p) != size {
+					b.Fatalf("read %d bytes, want %d", len(p), size)
+				}
+			}
+		})
+	}
+}
+
+// 返回调用 nextLine 的下一行的位置，格式和 ReadWatchdog 的日志相同
+func nextLine() string {
+	_, file, line, _ := runtime.Caller(1)
+	return fmt.Sprintf("%s:%d", file, line+1)
+}
+
+func TestReadWatchdogReportsCaller(t *testing.T) {
+	reads := []struct {
+		name string
+		read func(c *Conn) string // 开始一次会阻塞的读取，返回调用读取方法的位置
+	}{
+		{"ReadData", func(c *Conn) string {
+			site := nextLine()
+			go func() { c.ReadData() }()
+			return site
+		}},
+		{"ReadDataContext", func(c *Conn) string {
+			site := nextLine()
+			go func() { c.ReadDataContext(context.Background()) }()
+			return site
+		}},
+		{"ReadGob", func(c *Conn) string {
+			var v int
+			site := nextLine()
+			go func() { c.ReadGob(&v) }()
+			return site
+		}},
+		{"ReadLoop", func(c *Conn) string {
+			site := nextLine()
+			c.ReadLoop()
+			return site
+		}},
+		{"ReadNDJSON", func(c *Conn) string {
+			site := nextLine()
+			c.ReadNDJSON(NDJSONPerFrame)
+			return site
+		}},
+	}
+	for _, read := range reads {
+		t.Run(read.name, func(t *testing.T) {
+			c, peer := newTestServerConn()
+			defer peer.Close()
+			defer c.Close()
+			logger := &captureLogger{}
+			c.logger = logger
+			c.readWatchdog = 20 * time.Millisecond
+
+			site := read.read(c)
+			deadline := time.Now().Add(time.Second)
+			for len(logger.find("read blocked")) == 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			found := logger.find("read blocked")
+			if len(found) != 1 || !strings.HasSuffix(found[0], "called from "+site) {
+				t.Fatalf("watchdog logs = %q, want one ending with %q", found, site)
+			}
+		})
+	}
+}
+
+func TestHugeDeclaredLengthRejectedBeforeAllocating(t *testing.T) {
+	// 声明了 2^62 字节 payload 的帧，只发送帧头和 mask key
+	header := []byte{finalBit | BinaryMessage, maskBit | 127}
+	header = binary.BigEndian.AppendUint64(header, 1<<62)
+	header = append(header, 1, 2, 3, 4)
+
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{header})
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := c.ReadMessage()
+	runtime.ReadMemStats(&after)
+	if err != ErrMessageTooBig {
+		t.Fatalf("ReadMessage() error = %v, want ErrMessageTooBig", err)
+	}
+	if got := closeCodeOf(finish()); got != CloseMessageTooBig {
+		t.Fatalf("close code = %d, want %d", got, CloseMessageTooBig)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("allocated %d bytes before rejecting the frame", allocated)
+	}
+}
+
+func TestSeparateTextAndBinaryLimits(t *testing.T) {
+	cases := []struct {
+		typ    int
+		size   int
+		tooBig bool
+	}{
+		{TextMessage, 10, false},
+		{TextMessage, 11, true},
+		{BinaryMessage, 11, false},
+		{BinaryMessage, 100, false},
+		{BinaryMessage, 101, true},
+	}
+	for _, tc := range cases {
+		c, peer := newTestServerConn()
+		c.maxTextMessageSize = 10
+		c.maxBinaryMessageSize = 100
+		finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|byte(tc.typ), []byte(strings.Repeat("a", tc.size)))})
+
+		typ, data, err := c.ReadMessage()
+		if tc.tooBig {
+			if err != ErrMessageTooBig {
+				t.Errorf("type %d size %d: ReadMessage() error = %v, want ErrMessageTooBig", tc.typ, tc.size, err)
+			}
+			if got := closeCodeOf(finish()); got != CloseMessageTooBig {
+				t.Errorf("type %d size %d: close code = %d, want %d", tc.typ, tc.size, got, CloseMessageTooBig)
+			}
+		} else {
+			if err != nil || typ != tc.typ || len(data) != tc.size {
+				t.Errorf("type %d size %d: ReadMessage() = %d, %d bytes, %v", tc.typ, tc.size, typ, len(data), err)
+			}
+			finish()
+		}
+		c.Close()
+	}
+}
+
+func TestReadRouted(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|BinaryMessage, []byte("\x00\x00\x00\x2apayload")),
+		clientFrame(finalBit|TextMessage, []byte("abc")),
+	})
+	defer finish()
+
+	prefix, payload, typ, err := c.ReadRouted(4)
+	if err != nil || string(prefix) != "\x00\x00\x00\x2a" || string(payload) != "payload" || typ != BinaryMessage {
+		t.Fatalf("ReadRouted(4) = %q, %q, %d, %v, want the 4-byte prefix and payload", prefix, payload, typ, err)
+	}
+	if _, _, typ, err := c.ReadRouted(4); err == nil || typ != TextMessage {
+		t.Fatalf("ReadRouted(4) on a 3-byte message = %d, %v, want an error", typ, err)
+	}
+	if _, _, _, err := c.ReadRouted(-1); err == nil {
+		t.Fatal("ReadRouted(-1) error = nil, want an error")
+	}
+}
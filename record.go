@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"net"
+)
+
+// 记录原始字节流的连接，从底层连接读到的和写出的所有字节都会复制一份到对应的 io.Writer
+type recordingConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func newRecordingConn(conn net.Conn, read, write io.Writer) net.Conn {
+	rc := &recordingConn{Conn: conn, r: conn, w: conn}
+	if read != nil {
+		rc.r = io.TeeReader(conn, read)
+	}
+	if write != nil {
+		rc.w = io.MultiWriter(conn, write)
+	}
+	return rc
+}
+
+func (rc *recordingConn) Read(p []byte) (int, error) {
+	return rc.r.Read(p)
+}
+
+func (rc *recordingConn) Write(p []byte) (int, error) {
+	return rc.w.Write(p)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestRecordHandshakeAndFrames(t *testing.T) {
+	var read, written bytes.Buffer
+	addr, conns := newUpgradeTestServer(t, &Upgrader{RecordRead: &read, RecordWrite: &written})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 第一个帧和握手请求在同一次写入中发送，会被 net/http 读进缓冲区，也要被记录下来
+	first := clientFrame(finalBit|TextMessage, []byte("first"))
+	second := clientFrame(finalBit|BinaryMessage, []byte("second"))
+	req := "GET / HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + testChallengeKey + "\r\n\r\n"
+	if _, err := conn.Write(append([]byte(req), first...)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	if _, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(second); err != nil {
+		t.Fatal(err)
+	}
+
+	c := <-conns
+	defer c.Close()
+	for _, want := range []string{"first", "second"} {
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != want {
+			t.Fatalf("ReadMessage() = %q, %v, want %q", data, err, want)
+		}
+	}
+	if err := c.SendData([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	wantWritten := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n" +
+		"\r\n" +
+		"\x81\x02hi"
+	if written.String() != wantWritten {
+		t.Errorf("RecordWrite = %q, want %q", written.String(), wantWritten)
+	}
+	if wantRead := append(first, second...); !bytes.Equal(read.Bytes(), wantRead) {
+		t.Errorf("RecordRead = %x, want %x", read.Bytes(), wantRead)
+	}
+}
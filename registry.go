@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 记录所有存活的连接，服务退出时可以通过 Shutdown 通知它们关闭
+// 所有方法都可以在多个 goroutine 中并发调用
+type ConnRegistry struct {
+	mu           sync.Mutex
+	conns        map[*Conn]struct{}
+	shuttingDown bool
+}
+
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[*Conn]struct{})}
+}
+
+// 登记一个连接，调用 Shutdown 之后再登记的连接会直接以 1001 关闭
+func (r *ConnRegistry) Register(c *Conn) {
+	r.mu.Lock()
+	shuttingDown := r.shuttingDown
+	if !shuttingDown {
+		r.conns[c] = struct{}{}
+	}
+	r.mu.Unlock()
+
+	if shuttingDown {
+		c.SendClose(CloseGoingAway, "server shutting down")
+	}
+}
+
+// 移除一个连接，通常在处理连接的 goroutine 退出时调用
+func (r *ConnRegistry) Unregister(c *Conn) {
+	r.mu.Lock()
+	delete(r.conns, c)
+	r.mu.Unlock()
+}
+
+// 返回当前登记的连接数
+func (r *ConnRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// 向所有登记的连接发送 1001 的 close 帧，然后等待对端回应 close，或者等到 ctx 结束时强制关闭剩下的连接
+// 对端回应的 close 帧是在读取连接时处理的，所以每个连接都需要有 goroutine 在持续读取，否则只能等到 ctx 结束
+// 所有连接都正常关闭时返回 nil，否则返回 ctx 的错误
+func (r *ConnRegistry) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	r.shuttingDown = true
+	conns := make([]*Conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+
+	// 发送 close 帧的超时时间不超过 ctx 的截止时间
+	deadline := time.Now().Add(closeWriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	payload := closePayload(CloseGoingAway, "server shutting down")
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+
+			// 已经发送过 close 帧的连接同样只需要等待对端回应
+			if err := c.WriteControl(CloseMessage, payload, deadline); err != nil && err != ErrCloseSent {
+				c.Close()
+				return
+			}
+			select {
+			case <-c.Context().Done():
+			case <-ctx.Done():
+				c.Close()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
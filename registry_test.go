@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnRegistryShutdown(t *testing.T) {
+	r := NewConnRegistry()
+	var clients []*Conn
+	for i := 0; i < 3; i++ {
+		server, client := newTestConnPair()
+		defer server.Close()
+		defer client.Close()
+		r.Register(server)
+		clients = append(clients, client)
+		// 服务端需要持续读取才能处理对端回应的 close 帧
+		go func() {
+			for {
+				if _, err := server.ReadData(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	codes := make(chan uint16, len(clients))
+	for _, client := range clients {
+		go func(client *Conn) {
+			_, _, err := client.ReadMessage()
+			var ce *CloseError
+			if errors.As(err, &ce) {
+				codes <- ce.Code
+			} else {
+				codes <- 0
+			}
+		}(client)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	for range clients {
+		if code := <-codes; code != CloseGoingAway {
+			t.Fatalf("client close code = %d, want %d", code, CloseGoingAway)
+		}
+	}
+
+	// Shutdown 之后登记的连接直接以 1001 关闭
+	late, peer := newTestServerConn()
+	defer late.Close()
+	finish := runTestPeer(peer, nil)
+	r.Register(late)
+	if got := closeCodeOf(finish()); got != CloseGoingAway {
+		t.Fatalf("late conn close code = %d, want %d", got, CloseGoingAway)
+	}
+}
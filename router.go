@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// 根据 JSON 消息中的 type 字段分发消息的路由
+// 所有类型都应该在 Serve 之前注册好
+type Router struct {
+	handlers map[string]func(*Conn, json.RawMessage) error
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]func(*Conn, json.RawMessage) error)}
+}
+
+// 注册某个 type 的处理函数，处理函数收到的是完整的消息内容
+func (rt *Router) RegisterType(name string, handler func(*Conn, json.RawMessage) error) {
+	rt.handlers[name] = handler
+}
+
+// 循环读取消息并分发给对应的处理函数，读取出错或者处理函数返回错误时结束并返回该错误
+// 没有注册处理函数的 type 会记录日志后忽略
+func (rt *Router) Serve(c *Conn) error {
+	for {
+		data, err := c.ReadData()
+		if err != nil {
+			return err
+		}
+		if err := rt.dispatch(c, data); err != nil {
+			return err
+		}
+	}
+}
+
+func (rt *Router) dispatch(c *Conn, data []byte) error {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+
+	handler, ok := rt.handlers[envelope.Type]
+	if !ok {
+		c.logger.Printf("No handler registered for message type %q", envelope.Type)
+		return nil
+	}
+	return handler(c, json.RawMessage(data))
+}
+
+var (
+	messageTypesMu sync.RWMutex
+	messageTypes   = make(map[string]reflect.Type)
+)
+
+// 注册类型标记对应的 Go 类型，供 ReadJSONTyped 解码使用，proto 可以是结构体的值或者指针
+// proto 为 nil 时无法得到类型，返回错误；类型为 nil 的指针，比如 (*Chat)(nil)，是可以的
+func RegisterMessageType(tag string, proto interface{}) error {
+	t := reflect.TypeOf(proto)
+	if t == nil {
+		return fmt.Errorf("websocket: nil prototype for message type %q", tag)
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	messageTypesMu.Lock()
+	defer messageTypesMu.Unlock()
+	messageTypes[tag] = t
+	return nil
+}
+
+// 读取一条 JSON 消息，根据消息中的 type 字段找到通过 RegisterMessageType 注册的 Go 类型，
+// 把消息解码到该类型的一个新实例中，返回指向该实例的指针
+func (c *Conn) ReadJSONTyped() (interface{}, error) {
+	data, err := c.ReadData()
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+
+	messageTypesMu.RLock()
+	t, ok := messageTypes[envelope.Type]
+	messageTypesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("websocket: unregistered message type %q", envelope.Type)
+	}
+
+	v := reflect.New(t).Interface()
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
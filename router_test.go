@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type routerTestChat struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type routerTestJoin struct {
+	Type string `json:"type"`
+	Room int    `json:"room"`
+}
+
+func TestReadJSONTyped(t *testing.T) {
+	if err := RegisterMessageType("test-chat", routerTestChat{}); err != nil {
+		t.Fatalf("RegisterMessageType(value) error = %v", err)
+	}
+	if err := RegisterMessageType("test-join", (*routerTestJoin)(nil)); err != nil {
+		t.Fatalf("RegisterMessageType(nil pointer) error = %v", err)
+	}
+
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|TextMessage, []byte(`{"type":"test-chat","text":"hi"}`)),
+		clientFrame(finalBit|TextMessage, []byte(`{"type":"test-join","room":7}`)),
+		clientFrame(finalBit|TextMessage, []byte(`{"type":"test-unknown"}`)),
+	})
+	defer finish()
+
+	want := []interface{}{
+		&routerTestChat{Type: "test-chat", Text: "hi"},
+		&routerTestJoin{Type: "test-join", Room: 7},
+	}
+	for _, w := range want {
+		got, err := c.ReadJSONTyped()
+		if err != nil {
+			t.Fatalf("ReadJSONTyped() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Fatalf("ReadJSONTyped() = %#v, want %#v", got, w)
+		}
+	}
+	if _, err := c.ReadJSONTyped(); err == nil {
+		t.Fatal("ReadJSONTyped() of an unregistered type succeeded")
+	}
+}
+
+func TestRegisterMessageTypeNil(t *testing.T) {
+	if err := RegisterMessageType("test-nil", nil); err == nil {
+		t.Fatal("RegisterMessageType(nil) error = nil, want an error")
+	}
+	messageTypesMu.RLock()
+	_, ok := messageTypes["test-nil"]
+	messageTypesMu.RUnlock()
+	if ok {
+		t.Fatal("nil prototype was registered")
+	}
+}
+
+func TestRouterServe(t *testing.T) {
+	var got []string
+	rt := NewRouter()
+	rt.RegisterType("chat", func(c *Conn, data json.RawMessage) error {
+		got = append(got, "chat "+string(data))
+		return nil
+	})
+	rt.RegisterType("join", func(c *Conn, data json.RawMessage) error {
+		got = append(got, "join "+string(data))
+		return nil
+	})
+
+	c, peer := newTestServerConn()
+	defer c.Close()
+	logger := &captureLogger{}
+	c.SetLogger(logger)
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(finalBit|TextMessage, []byte(`{"type":"chat","text":"hi"}`)),
+		clientFrame(finalBit|TextMessage, []byte(`{"type":"unknown"}`)),
+		clientFrame(finalBit|TextMessage, []byte(`{"type":"join","room":7}`)),
+		clientFrame(finalBit|CloseMessage, closePayload(CloseNormalClosure, "")),
+	})
+	defer finish()
+
+	var ce *CloseError
+	if err := rt.Serve(c); !errors.As(err, &ce) {
+		t.Fatalf("Serve() error = %v, want *CloseError", err)
+	}
+	want := []string{`chat {"type":"chat","text":"hi"}`, `join {"type":"join","room":7}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handlers got %q, want %q", got, want)
+	}
+	if len(logger.find(`No handler registered for message type "unknown"`)) != 1 {
+		t.Errorf("unknown type not logged, got %q", logger.lines)
+	}
+}
+
+func TestRouterHandlerError(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	rt := NewRouter()
+	rt.RegisterType("chat", func(c *Conn, data json.RawMessage) error { return errHandler })
+
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|TextMessage, []byte(`{"type":"chat"}`))})
+	defer finish()
+
+	if err := rt.Serve(c); err != errHandler {
+		t.Fatalf("Serve() error = %v, want %v", err, errHandler)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// 从 JSON 消息中提取 id 字段，用来关联请求和响应
+func messageID(data []byte) (string, bool) {
+	var envelope struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil || len(envelope.ID) == 0 {
+		return "", false
+	}
+	return string(envelope.ID), true
+}
+
+// 以文本消息发送一条带 id 字段的 JSON 消息，然后等待 id 相同的响应，直到收到响应或者 ctx 结束
+// 只有文本消息才会被当作响应转交，所以 msg.Type 必须是 TextMessage，否则返回错误
+// 响应是由正在读取这个连接的 goroutine（ReadData 循环、ReadLoop 等）转交过来的，
+// 所以调用 Request 时必须有其他 goroutine 在持续读取这个连接
+func (c *Conn) Request(ctx context.Context, msg Message) (reply Message, err error) {
+	if msg.Type != TextMessage {
+		return Message{}, errors.New("websocket: request message must be a text message")
+	}
+	id, ok := messageID(msg.Data)
+	if !ok {
+		return Message{}, errors.New("websocket: request message has no id")
+	}
+
+	ch := make(chan Message, 1)
+	c.pendingMu.Lock()
+	if _, exists := c.pending[id]; exists {
+		c.pendingMu.Unlock()
+		return Message{}, errors.New("websocket: duplicate request id")
+	}
+	if c.pending == nil {
+		c.pending = make(map[string]chan Message)
+	}
+	c.pending[id] = ch
+	c.pendingMu.Unlock()
+
+	// 不管是收到响应还是超时都要把等待项删掉，避免泄漏
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+	}()
+
+	c.messageMu.Lock()
+	c.writeMu.Lock()
+	err = c.sendData(TextMessage, msg.Data)
+	c.writeMu.Unlock()
+	c.messageMu.Unlock()
+	if err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case reply = <-ch:
+		return reply, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// 把读取到的消息转交给等待中的 Request，返回 true 表示这条消息是某个请求的响应
+func (c *Conn) deliverReply(messageType int, data []byte) bool {
+	c.pendingMu.Lock()
+	if len(c.pending) == 0 {
+		c.pendingMu.Unlock()
+		return false
+	}
+	var ch chan Message
+	id, ok := messageID(data)
+	if ok {
+		ch, ok = c.pending[id]
+	}
+	if ok {
+		delete(c.pending, id)
+	}
+	c.pendingMu.Unlock()
+
+	if !ok {
+		return false
+	}
+	// 复用读缓冲区时数据会在下一次读取时被覆盖，需要复制一份
+	ch <- Message{Type: messageType, Data: append([]byte(nil), data...)}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentRequests(t *testing.T) {
+	server, client := newTCPConnPair(t)
+
+	// 服务端收到两个请求之后按相反的顺序回复
+	go func() {
+		var reqs [][]byte
+		for len(reqs) < 2 {
+			data, err := server.ReadData()
+			if err != nil {
+				return
+			}
+			reqs = append(reqs, data)
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			id, _ := messageID(reqs[i])
+			server.SendData([]byte(`{"id":` + id + `,"result":` + id + `}`))
+		}
+	}()
+	// 客户端需要有 goroutine 持续读取，响应才能转交给 Request
+	go func() {
+		for {
+			if _, err := client.ReadData(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, id := range []string{"1", `"two"`} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			reply, err := client.Request(ctx, Message{Type: TextMessage, Data: []byte(`{"id":` + id + `}`)})
+			if err != nil {
+				t.Errorf("Request(%s) error = %v", id, err)
+				return
+			}
+			if want := `{"id":` + id + `,"result":` + id + `}`; string(reply.Data) != want {
+				t.Errorf("Request(%s) reply = %s, want %s", id, reply.Data, want)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+func TestRequestTimeoutCleansUpPending(t *testing.T) {
+	server, client := newTCPConnPair(t)
+	received := make(chan []byte, 1)
+	go func() {
+		if data, err := server.ReadData(); err == nil {
+			received <- data
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.Request(ctx, Message{Type: TextMessage, Data: []byte(`{"id":7}`)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Request() error = %v, want context.DeadlineExceeded", err)
+	}
+	client.pendingMu.Lock()
+	n := len(client.pending)
+	client.pendingMu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d pending requests left after timeout", n)
+	}
+
+	// 超时之后才到达的响应作为普通消息读出来
+	<-received
+	go server.SendData([]byte(`{"id":7}`))
+	if data, err := client.ReadData(); err != nil || string(data) != `{"id":7}` {
+		t.Fatalf("ReadData() = %s, %v, want the late reply", data, err)
+	}
+}
+
+func TestRequestRejectsNonText(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	_, err := c.Request(context.Background(), Message{Type: BinaryMessage, Data: []byte(`{"id":1}`)})
+	if err == nil {
+		t.Fatal("Request() with a binary message error = nil, want an error")
+	}
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if len(c.pending) != 0 {
+		t.Fatalf("%d pending requests left after rejection", len(c.pending))
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+// NextWriter 没有协商最大帧长度时每个分片的长度
+const defaultWriteFrameSize = 4096
+
+var errWriterClosed = errors.New("websocket: write to closed message writer")
+
+// NextWriter 返回的 writer 还没有 Close 时再次调用 NextWriter 返回的错误
+var ErrWriterNotClosed = errors.New("websocket: previous message writer not closed")
+
+// 开始读取下一条消息，返回消息类型和一个读取消息 payload 的 io.Reader
+// payload 会边读边解除掩码，压缩的消息会边读边解压，分片消息的多个分片对调用方来说是连续的数据，读到消息末尾时返回 io.EOF
+// 文本消息会边读边检查 UTF-8，遇到不合法的字节时以 1007 关闭连接并返回 ErrInvalidUTF8
+// 期间收到的控制帧和 ReadData 一样在内部处理。消息不会整个放进内存，所以不受 MaxMessageSize 等长度限制和内存预算的约束
+// 返回的 reader 只在下一次调用 NextReader 或 ReadData 之前有效，那时还没有读完的部分会被丢弃
+func (c *Conn) NextReader() (messageType int, r io.Reader, err error) {
+	if c.closeErr != nil {
+		return 0, nil, c.closeErr
+	}
+	if err := c.discardReader(); err != nil {
+		return 0, nil, err
+	}
+
+	if c.deadlineFunc != nil {
+		c.conn.SetReadDeadline(c.deadlineFunc(false))
+	}
+
+	h, err := c.nextDataFrame(0)
+	if err != nil {
+		c.readFailed(err)
+		c.messageType = 0
+		return 0, nil, err
+	}
+
+	c.messageType = h.opcode
+	c.reader = &messageReader{c: c, messageType: h.opcode}
+	c.reader.startFrame(h)
+
+	r = c.reader
+	if h.compressed {
+		r = newInflater(r, c.dictionary)
+	}
+	if h.opcode == TextMessage {
+		r = &utf8Reader{c: c, r: r}
+	}
+	return h.opcode, r, nil
+}
+
+// 检查流式读取的文本消息是否是合法的 UTF-8
+// 一个字符可能被拆在两次读取中，所以每次读取末尾不完整的字符会留到下一次和后面的数据一起检查
+// 读到的数据直接在 p 中检查，只有拆开的那个字符需要和下一次读取开头的几个字节拼在一起，不会复制整块数据
+type utf8Reader struct {
+	c        *Conn
+	r        io.Reader
+	pending  [utf8.UTFMax]byte // 上一次读取末尾不完整的字符，最多 3 个字节
+	npending int
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	data := p[:n]
+
+	valid := true
+	if u.npending > 0 && len(data) > 0 {
+		// 从 data 开头逐个取字节补全上一次留下的字符，直到能解码出一个字符或者 data 用完
+		for u.npending < utf8.UTFMax && len(data) > 0 && !utf8.FullRune(u.pending[:u.npending]) {
+			u.pending[u.npending] = data[0]
+			u.npending++
+			data = data[1:]
+		}
+		if utf8.FullRune(u.pending[:u.npending]) {
+			r, size := utf8.DecodeRune(u.pending[:u.npending])
+			valid = !(r == utf8.RuneError && size == 1)
+			u.npending = 0
+		}
+	}
+
+	if valid && len(data) > 0 {
+		cut := len(data)
+		for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:]) {
+					cut = i
+				}
+				break
+			}
+		}
+		valid = utf8.Valid(data[:cut])
+		u.npending = copy(u.pending[:], data[cut:])
+	}
+
+	// 消息结束时还有不完整的字符也是不合法的
+	if !valid || (err == io.EOF && u.npending > 0) {
+		u.c.CloseWithError(ErrInvalidUTF8)
+		return n, ErrInvalidUTF8
+	}
+	return n, err
+}
+
+// 丢弃上一次 NextReader 返回的 reader 中还没有读完的数据
+func (c *Conn) discardReader() error {
+	r := c.reader
+	if r == nil {
+		return nil
+	}
+	c.reader = nil
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// 流式读取一条消息的 payload
+type messageReader struct {
+	c           *Conn
+	messageType int
+	final       bool    // 当前帧是否是消息的最后一个分片
+	remaining   int64   // 当前帧还没有读取的 payload 长度
+	masked      bool    // 当前帧是否带掩码
+	maskKey     [4]byte // 当前帧的 mask key，中间穿插的控制帧会覆盖 Conn 上的 mask key，所以单独保存一份
+	maskPos     int     // 已经解除掩码的字节数
+	err         error   // 读取出错之后后续的读取都返回这个错误
+}
+
+func (r *messageReader) startFrame(h frameHeader) {
+	r.final = h.final
+	r.remaining = h.length
+	r.masked = h.masked
+	r.maskKey = r.c.maskKey
+	r.maskPos = 0
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	// 当前帧已经读完时继续读取下一个分片，跳过空的分片
+	for r.remaining == 0 {
+		if r.final {
+			r.err = io.EOF
+			return 0, r.err
+		}
+		h, err := r.c.nextDataFrame(r.messageType)
+		if err != nil {
+			// 分片之间连接断开时不能返回 io.EOF，否则调用方会以为消息已经读完
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			r.c.readFailed(err)
+			r.err = err
+			return 0, err
+		}
+		r.startFrame(h)
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.c.br.Read(p)
+	r.remaining -= int64(n)
+	if r.masked {
+		r.maskPos = maskBytes(r.maskKey, r.maskPos, p[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.c.readFailed(err)
+		r.err = err
+	}
+	return n, err
+}
+
+// 开始写入一条消息，返回的 io.WriteCloser 会把写入的数据拆分成一个或多个帧发送，Close 时发送最后一个分片
+// 每个分片的长度是协商出的最大帧长度，没有协商时为 4096 字节，启用了压缩时写入的数据会先经过压缩
+// 从 NextWriter 到 Close 期间再次调用 NextWriter 会直接返回 ErrWriterNotClosed，两条消息的分片不能交错
+// 其他 goroutine 中调用的 SendData、WriteJSON 等会等到这条消息 Close 之后再发送，控制帧则可以插在分片之间发送
+// 在同一个 goroutine 中 Close 之前调用 SendData 等其他数据写方法会永远阻塞，所以调用方必须先调用 Close
+func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, errors.New("websocket: bad message type for NextWriter")
+	}
+	w, err := c.newMessageWriter(messageType, true)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// 创建一个 messageWriter，调用方负责检查消息类型
+// guard 为 true 时已经有 NextWriter 返回的 writer 还没有 Close 就返回 ErrWriterNotClosed，否则和其他数据消息一样等待 messageMu
+// WriteJSON 这种内部使用、一定会 Close 的 writer 不需要 guard
+func (c *Conn) newMessageWriter(messageType int, guard bool) (*messageWriter, error) {
+	size := c.caps.MaxFrameSize
+	if size <= 0 {
+		size = defaultWriteFrameSize
+	}
+
+	// 先标记再等待 messageMu，这样并发调用的两个 NextWriter 也只有一个能成功
+	if guard && !c.writerOpen.CompareAndSwap(false, true) {
+		return nil, ErrWriterNotClosed
+	}
+	c.messageMu.Lock()
+	w := &messageWriter{c: c, frameType: messageType, buf: make([]byte, 0, size), guard: guard}
+	if c.compression {
+		w.compressed = true
+		w.fw = getFlateWriter(c.dictionary)
+		w.tw = &truncWriter{w: w}
+		w.fw.Reset(w.tw)
+	}
+	return w, nil
+}
+
+// 流式写入一条消息
+type messageWriter struct {
+	c          *Conn
+	frameType  int           // 下一个分片的 opcode，第一个分片之后都是 ContinuationFrame
+	compressed bool          // 下一个分片是否需要设置 RSV1 位，只有压缩消息的第一个分片需要
+	fw         *flate.Writer // 启用压缩时写入的数据先经过它，压缩后的数据再通过 truncWriter 写入 buf
+	buf        []byte        // 还没有发送的数据，写满之后作为一个分片发送
+	err        error         // 写入出错之后后续的写入都返回这个错误
+	closed     bool
+	guard      bool // 是否设置了 Conn.writerOpen
+
+	tw *truncWriter // 启用压缩时 fw 写出的目标，记录了压缩后的长度
+	in int          // 启用压缩时已经写入的未压缩数据的长度
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.fw != nil {
+		n, err := w.fw.Write(p)
+		w.in += n
+		return n, err
+	}
+	if err := w.writeRaw(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 把要发送的数据写入缓冲区，写满之后发送一个分片
+func (w *messageWriter) writeRaw(p []byte) error {
+	for len(p) > 0 {
+		// 缓冲区满了并且还有数据要写时才发送，保证 Close 时总有数据留给最后一个分片
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flushFrame(false); err != nil {
+				return err
+			}
+		}
+		k := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+	}
+	return nil
+}
+
+// 把缓冲区中的数据作为一个分片发送
+func (w *messageWriter) flushFrame(final bool) error {
+	w.c.writeMu.Lock()
+	err := w.c.writeFrameLocked(w.frameType, final, w.compressed, w.buf)
+	w.c.writeMu.Unlock()
+	w.frameType = ContinuationFrame
+	w.compressed = false
+	w.buf = w.buf[:0]
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// 发送最后一个分片，结束这条消息
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.unlock()
+	defer w.releaseFlateWriter()
+
+	// 刷新压缩器，把剩下的压缩数据写入缓冲区，末尾的 4 个字节会留在 truncWriter 中被丢掉
+	if w.fw != nil && w.err == nil {
+		w.fw.Flush()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.tw != nil {
+		w.c.checkCompressionRatio(w.in, w.tw.written)
+	}
+	return w.flushFrame(true)
+}
+
+func (w *messageWriter) unlock() {
+	if w.guard {
+		w.c.writerOpen.Store(false)
+	}
+	w.c.messageMu.Unlock()
+}
+
+func (w *messageWriter) releaseFlateWriter() {
+	if w.fw != nil {
+		putFlateWriter(w.c.dictionary, w.fw)
+		w.fw = nil
+	}
+}
+
+// 放弃这条消息，还没有发送任何分片时不会发送任何数据，否则和 Close 一样发送最后一个分片
+func (w *messageWriter) abort() error {
+	if !w.closed && w.err == nil && w.frameType != ContinuationFrame {
+		w.closed = true
+		w.releaseFlateWriter()
+		w.unlock()
+		return nil
+	}
+	return w.Close()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// 每次只读取 sizes 中给出的长度，用于模拟调用方使用很小的缓冲区读取
+func readInChunks(r io.Reader, sizes ...int) ([]byte, error) {
+	var out []byte
+	for i := 0; ; i++ {
+		size := sizes[len(sizes)-1]
+		if i < len(sizes) {
+			size = sizes[i]
+		}
+		p := make([]byte, size)
+		n, err := r.Read(p)
+		out = append(out, p[:n]...)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+}
+
+func TestNextReaderUTF8SplitAcrossReads(t *testing.T) {
+	const msg = "xé a€"
+
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{
+		clientFrame(TextMessage, []byte(msg[:2])),
+		clientFrame(finalBit|ContinuationFrame, []byte(msg[2:])),
+	})
+	defer finish()
+
+	typ, r, err := c.NextReader()
+	if err != nil || typ != TextMessage {
+		t.Fatalf("NextReader() = %d, %v", typ, err)
+	}
+	got, err := readInChunks(r, 2, 4, 2)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(got) != msg {
+		t.Fatalf("Read() = %q, want %q", got, msg)
+	}
+}
+
+func TestNextReaderInvalidUTF8(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, [][]byte{clientFrame(finalBit|TextMessage, []byte("ok\xe2\x82"))})
+
+	_, r, err := c.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readInChunks(r, 1); err != ErrInvalidUTF8 {
+		t.Fatalf("Read() error = %v, want ErrInvalidUTF8", err)
+	}
+	if code := closeCodeOf(finish()); code != CloseInvalidFramePayloadData {
+		t.Fatalf("close code = %d, want %d", code, CloseInvalidFramePayloadData)
+	}
+}
+
+func TestUTF8ReaderChunkSizes(t *testing.T) {
+	inputs := []string{
+		"", "ascii", "xé a€😀", "\xef\xbf\xbd", "😀😀😀",
+		"ok\xe2\x82", "\xff", "a\xe2(b", "\xed\xa0\x80", "é\x80", "\xf0\x9f\x98",
+	}
+	for _, in := range inputs {
+		for size := 1; size <= 6; size++ {
+			c, _ := newRecordConn(true)
+			u := &utf8Reader{c: c, r: bytes.NewReader([]byte(in))}
+			got, err := readInChunks(u, size)
+			if want := utf8.ValidString(in); (err == nil) != want {
+				t.Errorf("%q in %d-byte reads: error = %v, want valid = %v", in, size, err, want)
+			} else if err == nil && string(got) != in {
+				t.Errorf("%q in %d-byte reads: Read() = %q", in, size, got)
+			}
+		}
+	}
+}
+
+// 检查时不复制读到的数据，读取大块文本不应该分配内存
+func TestUTF8ReaderDoesNotAllocate(t *testing.T) {
+	c, _ := newRecordConn(true)
+	data := bytes.Repeat([]byte("xé€😀"), 16<<10)
+	src := bytes.NewReader(data)
+	u := &utf8Reader{c: c, r: src}
+	p := make([]byte, 4093) // 不是 4 的倍数，每次读取末尾都可能拆开一个字符
+	allocs := testing.AllocsPerRun(10, func() {
+		src.Reset(data)
+		for {
+			if _, err := u.Read(p); err != nil {
+				if err != io.EOF {
+					t.Fatalf("Read() error = %v", err)
+				}
+				return
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("reading %d bytes allocated %v times, want 0", len(data), allocs)
+	}
+}
+
+// NextWriter 返回的 writer 还没有 Close 时，其他 goroutine 发送的数据消息等待它写完，而不是返回错误
+func TestSendDataWaitsForOpenWriter(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, nil)
+
+	w, err := c.NextWriter(TextMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("stream"))
+
+	sent := make(chan error, 1)
+	go func() { sent <- c.SendData([]byte("other")) }()
+	select {
+	case err := <-sent:
+		t.Fatalf("SendData() returned %v while the writer is open", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendData() error = %v", err)
+	}
+
+	frames := finish()
+	if len(frames) != 2 || string(frames[0].payload) != "stream" || string(frames[1].payload) != "other" {
+		t.Fatalf("frames = %+v, want \"stream\" then \"other\"", frames)
+	}
+}
+
+func TestNextWriterBeforeCloseFails(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, nil)
+
+	w, err := c.NextWriter(TextMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.NextWriter(BinaryMessage); err != ErrWriterNotClosed {
+		t.Fatalf("second NextWriter() error = %v, want ErrWriterNotClosed", err)
+	}
+
+	// 第一个 writer 不受影响，Close 之后可以再次调用 NextWriter
+	w.Write([]byte("first"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = c.NextWriter(BinaryMessage)
+	if err != nil {
+		t.Fatalf("NextWriter() after Close error = %v", err)
+	}
+	w.Write([]byte("second"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := finish()
+	if len(frames) != 2 || frames[0].opcode() != TextMessage || string(frames[0].payload) != "first" ||
+		frames[1].opcode() != BinaryMessage || string(frames[1].payload) != "second" {
+		t.Fatalf("frames = %+v, want text \"first\" then binary \"second\"", frames)
+	}
+}
+
+func TestNextWriterToNextReader1MB(t *testing.T) {
+	server, client := newTestConnPair()
+	defer server.Close()
+	defer client.Close()
+
+	payload := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	// 分成大小不一的块写入，跨越多个分片
+	errs := make(chan error, 1)
+	go func() {
+		w, err := client.NextWriter(BinaryMessage)
+		if err != nil {
+			errs <- err
+			return
+		}
+		for p, n := payload, 1; len(p) > 0; n = n*3 + 7 {
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				errs <- err
+				return
+			}
+			p = p[n:]
+		}
+		errs <- w.Close()
+	}()
+
+	typ, r, err := server.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader() error = %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if typ != BinaryMessage || !bytes.Equal(got, payload) {
+		t.Fatalf("NextReader() = %d, %d bytes, want the 1MB payload", typ, len(got))
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("writer error = %v", err)
+	}
+}
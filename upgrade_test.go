@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// RFC 6455 1.3 中的示例 key
+const testChallengeKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// 启动一个使用 u 升级协议的测试服务，升级成功的连接会发送到返回的 channel 上
+func newUpgradeTestServer(t *testing.T, u *Upgrader) (addr string, conns <-chan *Conn) {
+	t.Helper()
+	ch := make(chan *Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		ch <- c
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String(), ch
+}
+
+// 发送一个握手请求，extra 是额外的请求头，每一行都以 \r\n 结尾，返回服务端的响应和之后读取连接使用的缓冲读取器
+func rawHandshake(t *testing.T, addr string, extra string) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	req := "GET / HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + testChallengeKey + "\r\n" + extra + "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, conn, br
+}
+
+// 可以被劫持的 ResponseWriter，劫持得到的是 net.Pipe 的一端，用于直接调用 Upgrade
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (w hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// 创建一个合法的握手请求
+func newUpgradeRequest() *http.Request {
+	r := httptest.NewRequest("GET", "http://example.com/chat", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", testChallengeKey)
+	return r
+}
+
+func TestHandshakeWriteTimeout(t *testing.T) {
+	// 客户端一直不读取 101 响应，net.Pipe 没有缓冲，写入响应会一直阻塞到超时
+	a, b := net.Pipe()
+	defer b.Close()
+	u := &Upgrader{HandshakeWriteTimeout: 50 * time.Millisecond}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := u.Upgrade(hijackRecorder{httptest.NewRecorder(), a}, newUpgradeRequest())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("Upgrade() error = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upgrade() blocked although HandshakeWriteTimeout is set")
+	}
+}
+
+func TestRequireSubprotocol(t *testing.T) {
+	u := &Upgrader{Subprotocols: []string{"chat.v2"}, RequireSubprotocol: true}
+	addr, conns := newUpgradeTestServer(t, u)
+
+	for _, extra := range []string{"", "Sec-WebSocket-Protocol: chat.v1\r\n"} {
+		resp, _, _ := rawHandshake(t, addr, extra)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%q: status = %d, want 400", extra, resp.StatusCode)
+		}
+	}
+
+	resp, _, _ := rawHandshake(t, addr, "Sec-WebSocket-Protocol: chat.v1, chat.v2\r\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Protocol") != "chat.v2" {
+		t.Fatalf("status = %d, subprotocol = %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Protocol"))
+	}
+	c := <-conns
+	defer c.Close()
+	if c.Subprotocol() != "chat.v2" {
+		t.Fatalf("Subprotocol() = %q", c.Subprotocol())
+	}
+}
+
+func TestSelectSubprotocol(t *testing.T) {
+	u := &Upgrader{Subprotocols: []string{"chat.v2", "chat.v1"}}
+	addr, conns := newUpgradeTestServer(t, u)
+
+	tests := []struct {
+		extra string
+		want  string
+	}{
+		{"", ""},
+		{"Sec-WebSocket-Protocol: chat.v1\r\n", "chat.v1"},
+		{"Sec-WebSocket-Protocol: mqtt\r\n", ""},
+		// 多个都支持时按照客户端给出的顺序选择
+		{"Sec-WebSocket-Protocol: mqtt, chat.v1, chat.v2\r\n", "chat.v1"},
+		{"Sec-WebSocket-Protocol: mqtt\r\nSec-WebSocket-Protocol: chat.v2\r\n", "chat.v2"},
+	}
+	for _, tt := range tests {
+		resp, _, _ := rawHandshake(t, addr, tt.extra)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%q: status = %d, want 101", tt.extra, resp.StatusCode)
+		}
+		if values := resp.Header.Values("Sec-WebSocket-Protocol"); tt.want == "" && len(values) != 0 {
+			t.Errorf("%q: Sec-WebSocket-Protocol = %q, want no header", tt.extra, values)
+		} else if tt.want != "" && (len(values) != 1 || values[0] != tt.want) {
+			t.Errorf("%q: Sec-WebSocket-Protocol = %q, want %q", tt.extra, values, tt.want)
+		}
+		c := <-conns
+		if c.Subprotocol() != tt.want {
+			t.Errorf("%q: Subprotocol() = %q, want %q", tt.extra, c.Subprotocol(), tt.want)
+		}
+		c.Close()
+	}
+}
+
+func TestUpgradeResponseHeaders(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{})
+	resp, _, _ := rawHandshake(t, addr, "")
+	c := <-conns
+	defer c.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	// testChallengeKey 是 RFC 6455 1.3 中的示例 key，对应的 accept 也来自 RFC
+	want := map[string]string{
+		"Upgrade":              "websocket",
+		"Connection":           "Upgrade",
+		"Sec-WebSocket-Accept": "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+	}
+	for name, value := range want {
+		if got := resp.Header.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestConnAddrs(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{})
+	_, client, _ := rawHandshake(t, addr, "")
+	c := <-conns
+	defer c.Close()
+
+	if got, want := c.RemoteAddr().String(), client.LocalAddr().String(); got != want {
+		t.Errorf("RemoteAddr() = %s, want %s", got, want)
+	}
+	if got, want := c.LocalAddr().String(), client.RemoteAddr().String(); got != want {
+		t.Errorf("LocalAddr() = %s, want %s", got, want)
+	}
+}
+
+// 直接调用 Upgrade 处理请求 r，返回握手的状态码，升级成功时为 101
+func upgradeStatus(t *testing.T, u *Upgrader, r *http.Request) int {
+	t.Helper()
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+
+	rec := httptest.NewRecorder()
+	c, err := u.Upgrade(hijackRecorder{rec, a}, r)
+	if err != nil {
+		a.Close()
+		return rec.Code
+	}
+	c.Close()
+	return http.StatusSwitchingProtocols
+}
+
+func TestChallengeKeyValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  []string
+		lower []string // 直接以非规范化的名字 sec-websocket-key 设置的值
+		want  int
+	}{
+		{"valid key", []string{testChallengeKey}, nil, http.StatusSwitchingProtocols},
+		{"short key", []string{"c2hvcnQ="}, nil, http.StatusBadRequest},
+		{"15-byte key", []string{base64.StdEncoding.EncodeToString(make([]byte, 15))}, nil, http.StatusBadRequest},
+		{"not base64", []string{"!!!!!!!!!!!!!!!!!!!!!!!!"}, nil, http.StatusBadRequest},
+		{"duplicate header", []string{testChallengeKey, "AQIDBAUGBwgJCgsMDQ4PEA=="}, nil, http.StatusBadRequest},
+		{"duplicate identical header", []string{testChallengeKey, testChallengeKey}, nil, http.StatusBadRequest},
+		{"non-canonical header", nil, []string{testChallengeKey}, http.StatusSwitchingProtocols},
+		{"canonical and non-canonical header", []string{testChallengeKey}, []string{"AQIDBAUGBwgJCgsMDQ4PEA=="}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := newUpgradeRequest()
+		delete(r.Header, "Sec-Websocket-Key")
+		if tt.keys != nil {
+			r.Header["Sec-Websocket-Key"] = tt.keys
+		}
+		if tt.lower != nil {
+			r.Header["sec-websocket-key"] = tt.lower
+		}
+		if got := upgradeStatus(t, &Upgrader{}, r); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		check  func(r *http.Request) bool
+		want   int
+	}{
+		{"same origin", "http://example.com", nil, http.StatusSwitchingProtocols},
+		{"same origin different case", "https://EXAMPLE.com", nil, http.StatusSwitchingProtocols},
+		{"mismatched origin", "http://evil.example", nil, http.StatusForbidden},
+		{"mismatched port", "http://example.com:8080", nil, http.StatusForbidden},
+		{"missing origin", "", nil, http.StatusSwitchingProtocols},
+		{"custom check allows", "http://evil.example", func(r *http.Request) bool { return true }, http.StatusSwitchingProtocols},
+		{"custom check rejects", "", func(r *http.Request) bool { return false }, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := newUpgradeRequest()
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := upgradeStatus(t, &Upgrader{CheckOrigin: tt.check}, r); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConnectionHeaderTokens(t *testing.T) {
+	tests := []struct {
+		connection []string
+		want       int
+	}{
+		{[]string{"Upgrade"}, http.StatusSwitchingProtocols},
+		{[]string{"keep-alive, Upgrade"}, http.StatusSwitchingProtocols},
+		{[]string{"keep-alive,upgrade"}, http.StatusSwitchingProtocols},
+		{[]string{"keep-alive", "Upgrade"}, http.StatusSwitchingProtocols},
+		{[]string{"close"}, http.StatusBadRequest},
+		{[]string{"keep-alive"}, http.StatusBadRequest},
+		{[]string{"Upgraded"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := newUpgradeRequest()
+		r.Header["Connection"] = tt.connection
+		if got := upgradeStatus(t, &Upgrader{}, r); got != tt.want {
+			t.Errorf("Connection %q: status = %d, want %d", tt.connection, got, tt.want)
+		}
+	}
+}
+
+func TestFrameBufferedWithHandshake(t *testing.T) {
+	addr, conns := newUpgradeTestServer(t, &Upgrader{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 握手请求和第一个帧在同一次写入中发送，帧会和请求一起被 net/http 读进缓冲区
+	req := "GET / HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + testChallengeKey + "\r\n\r\n"
+	if _, err := conn.Write(append([]byte(req), clientFrame(0x81, []byte("early"))...)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	c := <-conns
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if data, err := c.ReadData(); err != nil || string(data) != "early" {
+		t.Fatalf("ReadData() = %q, %v, want %q", data, err, "early")
+	}
+}
+
+func TestHandshakeLimiter(t *testing.T) {
+	u := &Upgrader{HandshakeLimiter: NewRateLimiter(0.001, 2)}
+	want := []int{http.StatusSwitchingProtocols, http.StatusSwitchingProtocols, http.StatusServiceUnavailable}
+	for i, w := range want {
+		if got := upgradeStatus(t, u, newUpgradeRequest()); got != w {
+			t.Errorf("handshake %d: status = %d, want %d", i+1, got, w)
+		}
+	}
+}
+
+func TestStrictKeyCheck(t *testing.T) {
+	zero := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	repeated := base64.StdEncoding.EncodeToString([]byte("abcdabcdabcdabcd"))
+	tests := []struct {
+		key    string
+		strict bool
+		want   int
+	}{
+		{zero, true, http.StatusBadRequest},
+		{zero, false, http.StatusSwitchingProtocols},
+		{repeated, true, http.StatusBadRequest},
+		{repeated, false, http.StatusSwitchingProtocols},
+		{testChallengeKey, true, http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		r := newUpgradeRequest()
+		r.Header.Set("Sec-WebSocket-Key", tt.key)
+		if got := upgradeStatus(t, &Upgrader{StrictKeyCheck: tt.strict}, r); got != tt.want {
+			t.Errorf("key %q strict=%v: status = %d, want %d", tt.key, tt.strict, got, tt.want)
+		}
+	}
+}
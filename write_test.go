@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 丢弃所有写入数据的 net.Conn，用于测量写路径本身的开销
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+func (discardConn) Close() error                { return nil }
+
+func (discardConn) SetWriteDeadline(time.Time) error { return nil }
+
+// 创建一个写入会被丢弃的 Conn
+func newDiscardConn(isServer bool) *Conn {
+	return newConn(discardConn{}, bufio.NewReader(strings.NewReader("")), isServer)
+}
+
+func BenchmarkWriteTextString(b *testing.B) {
+	s := strings.Repeat("x", 1<<20)
+	b.Run("WriteTextString", func(b *testing.B) {
+		c := newDiscardConn(true)
+		b.ReportAllocs()
+		b.SetBytes(int64(len(s)))
+		for i := 0; i < b.N; i++ {
+			if err := c.WriteTextString(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SendData", func(b *testing.B) {
+		c := newDiscardConn(true)
+		b.ReportAllocs()
+		b.SetBytes(int64(len(s)))
+		for i := 0; i < b.N; i++ {
+			if err := c.SendData([]byte(s)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSendData(b *testing.B) {
+	data := make([]byte, 1024)
+	c := newDiscardConn(true)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if err := c.SendData(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSendDataDifferentSizes(t *testing.T) {
+	for _, isServer := range []bool{true, false} {
+		a, peer := net.Pipe()
+		c := newConn(a, bufio.NewReader(a), isServer)
+
+		// 先发送一条长消息，再发送一条短消息，第二次复用缓冲区时不能带出上一帧残留的数据
+		messages := [][]byte{bytes.Repeat([]byte("a"), 300), []byte("bb")}
+		errs := make(chan error, 1)
+		go func() {
+			for _, m := range messages {
+				if err := c.SendData(m); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+
+		for _, want := range messages {
+			f, err := readTestFrame(peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.b0 != finalBit|TextMessage || !bytes.Equal(f.payload, want) {
+				t.Fatalf("isServer=%v: frame = %#x %q, want %q", isServer, f.b0, f.payload, want)
+			}
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		peer.Close()
+	}
+}
+
+func TestWriteJSONStreamsFrames(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	want := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		want[fmt.Sprintf("key%d", i)] = strings.Repeat("v", 100)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- c.WriteJSON(want) }()
+
+	// 编码结果超过一个帧的长度，应该被分成多个帧发送
+	var data []byte
+	var frames int
+	for {
+		f, err := readTestFrame(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames++
+		data = append(data, f.payload...)
+		if f.b0&finalBit != 0 {
+			break
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+	if frames < 2 {
+		t.Fatalf("WriteJSON() wrote %d frames for %d bytes, want more than one", frames, len(data))
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d keys, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("key %q = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+// 记录所有写入数据的 net.Conn，用于检查写出的原始字节
+type recordConn struct {
+	discardConn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+// 创建一个记录所有写入数据的 Conn
+func newRecordConn(isServer bool) (*Conn, *recordConn) {
+	rc := &recordConn{}
+	return newConn(rc, bufio.NewReader(strings.NewReader("")), isServer), rc
+}
+
+func TestServerFramesNeverMasked(t *testing.T) {
+	for _, n := range []int{125, 126, 65536} {
+		payload := bytes.Repeat([]byte{'s'}, n)
+		writes := []struct {
+			name  string
+			write func(c *Conn) error
+		}{
+			{"SendData", func(c *Conn) error { return c.SendData(payload) }},
+			{"SendBinary", func(c *Conn) error { return c.SendBinary(payload) }},
+			{"WriteTextString", func(c *Conn) error { return c.WriteTextString(string(payload)) }},
+		}
+		for _, w := range writes {
+			c, rc := newRecordConn(true)
+			if err := w.write(c); err != nil {
+				t.Fatalf("%s(%d bytes) error = %v", w.name, n, err)
+			}
+			raw := rc.buf.Bytes()
+			if raw[1]&maskBit != 0 {
+				t.Fatalf("%s(%d bytes): second header byte = %#x, MASK bit set", w.name, n, raw[1])
+			}
+			// 没有 mask key，payload 紧跟在帧头后面并且没有经过掩码处理
+			if !bytes.HasSuffix(raw, payload) || len(raw)-n > 10 {
+				t.Fatalf("%s(%d bytes): wrote %d bytes, payload is not sent in the clear", w.name, n, len(raw))
+			}
+		}
+	}
+}
+
+func TestFrameMaskByRole(t *testing.T) {
+	payload := []byte("role check")
+	for _, isServer := range []bool{true, false} {
+		writes := []struct {
+			name  string
+			write func(c *Conn) error
+		}{
+			{"SendData", func(c *Conn) error { return c.SendData(payload) }},
+			{"WriteControl", func(c *Conn) error { return c.WriteControl(PingMessage, payload, time.Time{}) }},
+			{"NextWriter", func(c *Conn) error {
+				w, err := c.NextWriter(BinaryMessage)
+				if err != nil {
+					return err
+				}
+				w.Write(payload)
+				return w.Close()
+			}},
+		}
+		for _, w := range writes {
+			c, rc := newRecordConn(isServer)
+			if err := w.write(c); err != nil {
+				t.Fatalf("isServer=%v %s error = %v", isServer, w.name, err)
+			}
+			raw := rc.buf.Bytes()
+			masked := raw[1]&maskBit != 0
+			if masked == isServer {
+				t.Fatalf("isServer=%v %s: MASK bit = %v, want %v", isServer, w.name, masked, !isServer)
+			}
+			body := raw[2:]
+			if masked {
+				// 客户端的帧在帧头之后是 4 字节的 mask key，payload 经过掩码处理
+				var key [4]byte
+				copy(key[:], body[:4])
+				body = append([]byte(nil), body[4:]...)
+				maskBytes(key, 0, body)
+			}
+			if !bytes.Equal(body, payload) {
+				t.Fatalf("isServer=%v %s: payload = %q, want %q", isServer, w.name, body, payload)
+			}
+		}
+	}
+}
+
+func TestWrittenLengthHeader(t *testing.T) {
+	tests := []struct {
+		n      int
+		header []byte
+	}{
+		{125, []byte{finalBit | BinaryMessage, 125}},
+		{126, []byte{finalBit | BinaryMessage, 126, 0x00, 0x7e}},
+		{65535, []byte{finalBit | BinaryMessage, 126, 0xff, 0xff}},
+		{65536, []byte{finalBit | BinaryMessage, 127, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		c, rc := newRecordConn(true)
+		if err := c.SendBinary(make([]byte, tt.n)); err != nil {
+			t.Fatalf("SendBinary(%d bytes) error = %v", tt.n, err)
+		}
+		raw := rc.buf.Bytes()
+		if !bytes.Equal(raw[:len(tt.header)], tt.header) || len(raw) != len(tt.header)+tt.n {
+			t.Errorf("SendBinary(%d bytes) header = % x, total %d bytes, want % x and %d bytes",
+				tt.n, raw[:len(tt.header)], len(raw), tt.header, len(tt.header)+tt.n)
+		}
+	}
+}
+
+func TestConcurrentSendData(t *testing.T) {
+	const writers = 50
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	// 每个 goroutine 发送一条长度不同、内容可以辨认的消息，帧交错时 peer 会读到错乱的帧头或者内容
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			errs <- c.SendData(bytes.Repeat([]byte{byte('A' + i%26)}, 100+i*50))
+		}(i)
+	}
+
+	seen := make(map[int]bool)
+	for i := 0; i < writers; i++ {
+		f, err := readTestFrame(peer)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		n := (len(f.payload) - 100) / 50
+		want := bytes.Repeat([]byte{byte('A' + n%26)}, 100+n*50)
+		if f.b0 != finalBit|TextMessage || !bytes.Equal(f.payload, want) || seen[n] {
+			t.Fatalf("frame %d: %#x with %d bytes is corrupted or repeated", i, f.b0, len(f.payload))
+		}
+		seen[n] = true
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("SendData() error = %v", err)
+		}
+	}
+}
+
+func TestWriteControl(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, nil)
+
+	deadline := time.Now().Add(time.Second)
+	if err := c.WriteControl(PingMessage, []byte("ping"), deadline); err != nil {
+		t.Fatalf("WriteControl(ping) error = %v", err)
+	}
+	if err := c.WriteControl(PongMessage, []byte("pong"), deadline); err != nil {
+		t.Fatalf("WriteControl(pong) error = %v", err)
+	}
+	if err := c.WriteControl(PingMessage, make([]byte, maxControlFramePayload+1), deadline); err != errControlFrameTooLong {
+		t.Errorf("WriteControl(126 bytes) error = %v, want %v", err, errControlFrameTooLong)
+	}
+	if err := c.WriteControl(TextMessage, []byte("text"), deadline); err == nil {
+		t.Error("WriteControl(TextMessage) error = nil, want error")
+	}
+
+	frames := finish()
+	if len(frames) != 2 ||
+		frames[0].b0 != 0x89 || string(frames[0].payload) != "ping" ||
+		frames[1].b0 != 0x8A || string(frames[1].payload) != "pong" {
+		t.Fatalf("peer received %+v, want ping and pong", frames)
+	}
+}
+
+func TestWriteControlDeadline(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	// 对端不读取，net.Pipe 的写入会一直阻塞，已经过去的 deadline 应该让写入立即超时
+	err := c.WriteControl(PingMessage, nil, time.Now().Add(-time.Second))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("WriteControl() error = %v, want timeout", err)
+	}
+
+	// 超时只对这一个帧生效，之后的写入恢复原来没有超时的状态
+	finish := runTestPeer(peer, nil)
+	if err := c.WriteControl(PingMessage, []byte("again"), time.Time{}); err != nil {
+		t.Fatalf("WriteControl() after timeout error = %v", err)
+	}
+	if frames := finish(); len(frames) != 1 || string(frames[0].payload) != "again" {
+		t.Fatalf("peer received %+v, want one ping", frames)
+	}
+}
+
+// WriteBatch 期间收到 ping，自动回复的 pong 要等到批量写入结束之后才发送，不会插在两条消息之间
+func TestWriteBatchNotInterleavedWithPong(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	finish := runTestPeer(peer, nil)
+
+	read := make(chan string, 1)
+	err := c.WriteBatch(func(w BatchWriter) error {
+		if err := w.SendData([]byte("a")); err != nil {
+			return err
+		}
+		go func() {
+			data, _ := c.ReadData()
+			read <- string(data)
+		}()
+		// 对端的写入返回时服务端已经读走了 ping，给读取的 goroutine 一点时间去尝试回复 pong
+		if _, err := peer.Write(clientFrame(finalBit|PingMessage, []byte("p"))); err != nil {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+		return w.SendData([]byte("b"))
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch() error = %v", err)
+	}
+
+	// 读到这条消息时 pong 已经写出
+	if _, err := peer.Write(clientFrame(finalBit|TextMessage, []byte("done"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-read; got != "done" {
+		t.Fatalf("ReadData() = %q, want %q", got, "done")
+	}
+
+	frames := finish()
+	var got []string
+	for _, f := range frames {
+		got = append(got, fmt.Sprintf("%d:%s", f.opcode(), f.payload))
+	}
+	want := []string{"1:a", "1:b", "10:p"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("peer received %v, want %v", got, want)
+	}
+}
+
+// 第一次写入只写出一部分并返回 io.ErrShortWrite 的连接
+type shortWriteConn struct {
+	recordConn
+	short bool
+}
+
+func (c *shortWriteConn) Write(p []byte) (int, error) {
+	if !c.short && len(p) > 1 {
+		c.short = true
+		n, _ := c.recordConn.Write(p[:len(p)/2])
+		return n, io.ErrShortWrite
+	}
+	return c.recordConn.Write(p)
+}
+
+func TestWriteRetriesShortWrite(t *testing.T) {
+	sc := &shortWriteConn{}
+	c := newConn(sc, bufio.NewReader(strings.NewReader("")), true)
+	payload := bytes.Repeat([]byte("x"), 300)
+	if err := c.SendData(payload); err != nil {
+		t.Fatalf("SendData() error = %v", err)
+	}
+	if !sc.short {
+		t.Fatal("short write not triggered")
+	}
+	f, err := readTestFrame(&sc.buf)
+	if err != nil || f.b0 != finalBit|TextMessage || !bytes.Equal(f.payload, payload) {
+		t.Fatalf("frame = %x %d bytes, %v, want the full text frame", f.b0, len(f.payload), err)
+	}
+}
+
+func TestSendDataAfterPeerClosed(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	peer.Close()
+
+	if err := c.SendData([]byte("hello")); err == nil {
+		t.Fatal("SendData() error = nil, want an error after the peer closed")
+	}
+}
+
+func TestWriteMessageWithDeadline(t *testing.T) {
+	c, peer := newTestServerConn()
+	defer c.Close()
+	defer peer.Close()
+
+	err := c.writeMessageWithDeadline(TextMessage, []byte("late"), time.Now().Add(-time.Second))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("writeMessageWithDeadline() error = %v, want timeout", err)
+	}
+
+	// 超时只对这一条消息生效，之后的写入恢复原来没有超时的状态
+	finish := runTestPeer(peer, nil)
+	if err := c.SendData([]byte("again")); err != nil {
+		t.Fatalf("SendData() after timeout error = %v", err)
+	}
+	if frames := finish(); len(frames) != 1 || string(frames[0].payload) != "again" {
+		t.Fatalf("peer received %+v, want one text frame", frames)
+	}
+}
+
+func TestWriteMessageRoundTrip(t *testing.T) {
+	server, client := newTCPConnPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	messages := []struct {
+		typ  int
+		data string
+	}{
+		{TextMessage, "hello"},
+		{BinaryMessage, "\x00\x01\x02"},
+	}
+	for _, m := range messages {
+		if err := client.WriteMessage(m.typ, []byte(m.data)); err != nil {
+			t.Fatalf("WriteMessage(%d) error = %v", m.typ, err)
+		}
+		if typ, data, err := server.ReadMessage(); err != nil || typ != m.typ || string(data) != m.data {
+			t.Fatalf("ReadMessage() = %d, %q, %v, want %d, %q", typ, data, err, m.typ, m.data)
+		}
+	}
+
+	for _, typ := range []int{ContinuationFrame, 3, 11} {
+		if err := client.WriteMessage(typ, []byte("x")); err == nil {
+			t.Errorf("WriteMessage(%d) error = nil, want an error", typ)
+		}
+	}
+}